@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/lutfailham96/go-tcp-proxy-tunnel/internal/tcp"
+	"github.com/lutfailham96/go-tcp-proxy-tunnel/pkg/proxy"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+func startAdminServer(addr string, registry *proxy.Registry, pools []*tcp.BackendPool) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		fmt.Printf("Invalid admin address '%s'\n", err)
+		return
+	}
+	// bind to localhost unless a host is given explicitly
+	if host == "" {
+		addr = net.JoinHostPort("127.0.0.1", port)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/conns", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, registry.List())
+	})
+	mux.HandleFunc("/conns/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		connId, err := strconv.ParseUint(strings.TrimPrefix(r.URL.Path, "/conns/"), 10, 64)
+		if err != nil {
+			http.Error(w, "invalid connection id", http.StatusBadRequest)
+			return
+		}
+		p := registry.Get(connId)
+		if p == nil {
+			http.Error(w, "connection not found", http.StatusNotFound)
+			return
+		}
+		p.Close()
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]interface{}{
+			"active_connections": registry.Len(),
+			"rewrites":           proxy.Rewrites(),
+			"backends":           backendStates(pools),
+			"connection_bytes":   closedConns.bytes.snapshot(),
+			"connection_seconds": closedConns.duration.snapshot(),
+			"labels":             proxy.LabelStats(),
+		})
+	})
+
+	mux.HandleFunc("/debug", func(w http.ResponseWriter, r *http.Request) {
+		// forwarders above twice the active connections or goroutines growing while connections do not
+		// point at goroutines that never exited
+		writeJSON(w, map[string]interface{}{
+			"goroutines":         runtime.NumGoroutine(),
+			"active_connections": registry.Len(),
+			"active_forwarders":  proxy.ActiveForwarders(),
+		})
+	})
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	fmt.Printf("Admin server\t: %s\n", addr)
+	go func() {
+		err := http.ListenAndServe(addr, mux)
+		if err != nil {
+			fmt.Printf("Cannot start admin server '%s'\n", err)
+		}
+	}()
+}
+
+// backendStates lists the backends of every pool once, listeners may share a pool
+func backendStates(pools []*tcp.BackendPool) []tcp.BackendState {
+	states := make([]tcp.BackendState, 0)
+	seen := make(map[*tcp.BackendPool]bool)
+	for _, pool := range pools {
+		if pool == nil || seen[pool] {
+			continue
+		}
+		seen[pool] = true
+		states = append(states, pool.States()...)
+	}
+	return states
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		fmt.Printf("Cannot encode admin response '%s'\n", err)
+	}
+}
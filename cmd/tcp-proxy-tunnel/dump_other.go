@@ -0,0 +1,10 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package main
+
+import (
+	"github.com/lutfailham96/go-tcp-proxy-tunnel/pkg/proxy"
+)
+
+func handleDumpSignal(registry *proxy.Registry) {}
@@ -0,0 +1,29 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package main
+
+import (
+	"fmt"
+	"github.com/lutfailham96/go-tcp-proxy-tunnel/pkg/proxy"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// dump active connections to stderr on SIGUSR1
+func handleDumpSignal(registry *proxy.Registry) {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGUSR1)
+	go func() {
+		for range sigCh {
+			conns := registry.List()
+			fmt.Fprintf(os.Stderr, "Active connections: %d\n", len(conns))
+			for _, c := range conns {
+				fmt.Fprintf(os.Stderr, "CONN #%d %s >> %s >> %s (%d bytes sent, %d bytes received, %s)\n",
+					c.Id, c.Client, c.Local, c.Remote, c.BytesSent, c.BytesReceived, c.Age.Round(time.Second))
+			}
+		}
+	}()
+}
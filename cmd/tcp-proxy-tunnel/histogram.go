@@ -0,0 +1,86 @@
+package main
+
+import (
+	"github.com/lutfailham96/go-tcp-proxy-tunnel/pkg/proxy"
+	"math"
+	"strconv"
+	"sync"
+)
+
+var (
+	// 1KiB to 1GiB in powers of 4
+	bytesBuckets = []float64{1 << 10, 1 << 12, 1 << 14, 1 << 16, 1 << 18, 1 << 20, 1 << 22, 1 << 24, 1 << 26, 1 << 28, 1 << 30}
+	// seconds
+	durationBuckets = []float64{0.1, 0.5, 1, 5, 10, 30, 60, 300, 900, 3600}
+)
+
+// closedConns collects the size and duration of closed connections for /metrics
+var closedConns = &connHistograms{
+	bytes:    newHistogram(bytesBuckets),
+	duration: newHistogram(durationBuckets),
+}
+
+type connHistograms struct {
+	bytes    *histogram
+	duration *histogram
+}
+
+func (h *connHistograms) observe(info proxy.ConnInfo) {
+	h.bytes.observe(float64(info.BytesSent + info.BytesReceived))
+	h.duration.observe(info.Age.Seconds())
+}
+
+// histogram counts observations in cumulative buckets, the last bucket is +Inf
+type histogram struct {
+	mu     sync.Mutex
+	bounds []float64
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+type histogramBucket struct {
+	Le    string `json:"le"`
+	Count uint64 `json:"count"`
+}
+
+type histogramSnapshot struct {
+	Buckets []histogramBucket `json:"buckets"`
+	Count   uint64            `json:"count"`
+	Sum     float64           `json:"sum"`
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{
+		bounds: bounds,
+		counts: make([]uint64, len(bounds)+1),
+	}
+}
+
+func (h *histogram) observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	i := 0
+	for i < len(h.bounds) && v > h.bounds[i] {
+		i++
+	}
+	h.counts[i]++
+	h.count++
+	h.sum += v
+}
+
+func (h *histogram) snapshot() histogramSnapshot {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	buckets := make([]histogramBucket, len(h.counts))
+	var cumulative uint64
+	for i, count := range h.counts {
+		cumulative += count
+		bound := math.Inf(1)
+		if i < len(h.bounds) {
+			bound = h.bounds[i]
+		}
+		buckets[i] = histogramBucket{Le: strconv.FormatFloat(bound, 'f', -1, 64), Count: cumulative}
+	}
+	return histogramSnapshot{Buckets: buckets, Count: h.count, Sum: h.sum}
+}
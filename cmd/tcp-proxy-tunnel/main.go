@@ -1,36 +1,180 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"flag"
 	"fmt"
 	"github.com/lutfailham96/go-tcp-proxy-tunnel/internal/common"
+	"github.com/lutfailham96/go-tcp-proxy-tunnel/internal/tcp"
 	"github.com/lutfailham96/go-tcp-proxy-tunnel/internal/util"
 	"github.com/lutfailham96/go-tcp-proxy-tunnel/pkg/proxy"
 	"net"
 	"os"
 	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 var (
-	localAddr           = flag.String("l", "127.0.0.1:8082", "local address")
-	remoteAddr          = flag.String("r", "127.0.0.1:443", "remote address")
+	localAddr           = flag.String("l", "127.0.0.1:8082", "local address, comma separated or a port range like 127.0.0.1:8000-8010 to listen on several")
+	remoteAddr          = flag.String("r", "127.0.0.1:443", "remote address, comma separated or a port range to pair with each local address, or a DNS SRV name like _tunnel._tcp.example.com")
 	serverHost          = flag.String("s", "", "server host address")
 	disableServerResolv = flag.Bool("dsr", false, "disable server host resolve")
 	serverProxyMode     = flag.Bool("sv", false, "run on server mode")
+	bidirectional       = flag.Bool("bidirectional", false, "forward both directions from the start on server mode, for protocols without a websocket upgrade")
 	localPayload        = flag.String("op", "", "local TCP payload replacer")
 	remotePayload       = flag.String("ip", "", "remote TCP payload replacer")
 	bufferSize          = flag.Uint64("bs", 0, "connection buffer size")
 	tlsEnabled          = flag.Bool("tls", false, "enable tls/secure connection")
 	sniHost             = flag.String("sni", "", "SNI hostname")
+	tlsFingerprint      = flag.String("tls-fingerprint", "", "send the ClientHello of a browser on the remote TLS handshake [chrome, firefox, ios, randomized]")
 	configFile          = flag.String("c", "", "load config from JSON file")
 	tlsCert             = flag.String("cert", "", "tls cert pem file")
 	tlsKey              = flag.String("key", "", "tls key pem file")
-	proxyKind           = flag.String("k", "ssh", "proxy kind [ssh, trojan] (default: ssh)")
+	proxyKind           = flag.String("k", "ssh", "proxy kind [ssh, trojan, ws, h2-connect, ss, udp-over-tcp] (default: ssh)")
+	wsPath              = flag.String("ws-path", "/", "websocket path used on ws proxy kind")
+	wsHost              = flag.String("ws-host", "", "host of the wss:// URL used on trojan proxy kind, defaults to the SNI hostname")
+	trojanPassword      = flag.String("trojan-password", "", "send a Trojan protocol request with this password on trojan proxy kind instead of rewriting the path")
+	trojanTarget        = flag.String("trojan-target", "", "host:port the Trojan server connects to, defaults to the server host")
+	ssPassword          = flag.String("ss-password", "", "password of the Shadowsocks AEAD stream on ss proxy kind")
+	ssCipher            = flag.String("ss-cipher", "chacha20-ietf-poly1305", "cipher of the Shadowsocks AEAD stream on ss proxy kind")
+	dialIPv4            = flag.Bool("4", false, "dial remote over IPv4 only")
+	dialIPv6            = flag.Bool("6", false, "dial remote over IPv6 only")
+	dialSourceAddr      = flag.String("src", "", "source ip for remote connections, a port must be 0 or left out")
+	fwMark              = flag.Int("fwmark", 0, "SO_MARK applied to remote connections (linux only)")
+	decoyFile           = flag.String("decoy", "", "response file sent to non websocket requests on server mode")
+	decoyBackend        = flag.String("decoy-backend", "", "backend address non websocket requests are forwarded to on server mode")
+	authHeader          = flag.String("auth-header", "X-Auth-Token", "header carrying the auth token on server mode")
+	authToken           = flag.String("auth-token", "", "auth token required on server mode upgrade requests")
+	psk                 = flag.String("psk", "", "pre-shared key for challenge-response auth between paired proxies")
+	openGracePeriod     = flag.Duration("open-grace", 0, "close connections that transfer no bytes within this period")
+	linger              = flag.Int("linger", -1, "SO_LINGER seconds of both connections, 0 resets (RST) on close, -1 keeps the system default")
+	handshakeTimeout    = flag.Duration("handshake-timeout", 0, "close server mode connections that send no handshake within this period")
+	maxConnDuration     = flag.Duration("max-duration", 0, "close connections after this period regardless of activity")
+	statsInterval       = flag.Duration("stats-interval", 0, "log the bytes transferred by open connections every period (disabled if 0)")
+	writeTimeout        = flag.Duration("write-timeout", 0, "close connections when a write blocks longer than this period")
+	transparent         = flag.Bool("transparent", false, "forward to the original destination of connections redirected by iptables (linux only)")
+	tproxy              = flag.Bool("tproxy", false, "accept TPROXY connections and dial their original destination from the client ip (linux only)")
+	listenBacklog       = flag.Int("backlog", 0, "accept queue length of the listeners, capped by net.core.somaxconn (linux only, system default if 0)")
+	reusePort           = flag.Bool("reuseport", false, "set SO_REUSEPORT on the listeners so several processes share the local address (linux only)")
+	shutdownTimeout     = flag.Duration("shutdown-timeout", 30*time.Second, "period active connections get to finish on SIGTERM before they are force closed")
+	maxPerIP            = flag.Int("max-per-ip", 0, "concurrent connections allowed for each client ip, 0 disables the limit")
+	allowDestinations   = flag.String("allow-dest", "", "comma separated CIDRs, hosts or host:port patterns remote connections may reach, e.g. 10.0.0.0/8,*.example.com:443 (any if empty)")
+	workers             = flag.Int("workers", 0, "number of goroutines running connections from a queue of the same size (a goroutine per connection if 0)")
+	queueFull           = flag.String("queue-full", "block", "policy when the worker queue is full [block, close], block stops accepting until a worker is free")
+	idleTimeout         = flag.Duration("idle-timeout", 0, "close connections that transfer no bytes for this period, checked every -idle-interval (disabled if 0)")
+	idleInterval        = flag.Duration("idle-interval", 30*time.Second, "interval connections are checked against -idle-timeout")
+	maxHandshakes       = flag.Int("max-handshakes", 0, "maximum connections dialing and handshaking with the remote at once (unlimited if 0)")
+	backendsFile        = flag.String("backends-file", "", "file listing one backend address per line, watched for changes and used instead of -r")
+	breakerFailures     = flag.Int("breaker-failures", 3, "consecutive dial failures that take a backend out of rotation (disabled if 0)")
+	breakerCooldown     = flag.Duration("breaker-cooldown", 30*time.Second, "period a failing backend stays out of rotation before it is probed")
+	drainTimeout        = flag.Duration("drain-timeout", 0, "close connections of backends removed from the pool after this period (drain until closed if 0)")
+	sniRoutes           = flag.String("sni-routes", "", "route TLS connections by ClientHello SNI without decrypting, e.g. a.example.com=10.0.0.1:443,*.example.com=10.0.0.2:443,*=10.0.0.3:443")
+	rawRemote           = flag.String("raw-remote", "", "forward connections not starting with -tunnel-magic untouched to this address, sharing the port with the tunnel")
+	tunnelMagic         = flag.String("tunnel-magic", "GET ", "first bytes of tunnel connections when -raw-remote is set")
+	labels              = flag.String("labels", "", "comma separated key=value labels added to logs, /conns and /metrics, e.g. tenant=acme,service=ssh")
+	srvRefresh          = flag.Duration("srv-refresh", 30*time.Second, "interval SRV remote addresses are looked up again")
+	logJSON             = flag.Bool("log-json", false, "log connection events as JSON")
+	debug               = flag.Bool("debug", false, "log debug events")
+	adminAddr           = flag.String("admin", "", "admin server address, e.g. 127.0.0.1:9000 (disabled if empty)")
 )
 
+// flagEnv maps flag names to the environment variables that set them when the flag is not given
+var flagEnv = map[string]string{
+	"l":                 "TPT_LOCAL_ADDR",
+	"r":                 "TPT_REMOTE_ADDR",
+	"s":                 "TPT_SERVER_HOST",
+	"dsr":               "TPT_DISABLE_SERVER_RESOLV",
+	"sv":                "TPT_SERVER_MODE",
+	"op":                "TPT_LOCAL_PAYLOAD",
+	"ip":                "TPT_REMOTE_PAYLOAD",
+	"bs":                "TPT_BUFFER_SIZE",
+	"tls":               "TPT_TLS",
+	"sni":               "TPT_SNI",
+	"c":                 "TPT_CONFIG",
+	"cert":              "TPT_TLS_CERT",
+	"key":               "TPT_TLS_KEY",
+	"k":                 "TPT_PROXY_KIND",
+	"ws-path":           "TPT_WS_PATH",
+	"ws-host":           "TPT_WS_HOST",
+	"trojan-password":   "TPT_TROJAN_PASSWORD",
+	"trojan-target":     "TPT_TROJAN_TARGET",
+	"ss-password":       "TPT_SS_PASSWORD",
+	"tls-fingerprint":   "TPT_TLS_FINGERPRINT",
+	"ss-cipher":         "TPT_SS_CIPHER",
+	"bidirectional":     "TPT_BIDIRECTIONAL",
+	"4":                 "TPT_IPV4",
+	"6":                 "TPT_IPV6",
+	"src":               "TPT_SOURCE_ADDR",
+	"fwmark":            "TPT_FWMARK",
+	"decoy":             "TPT_DECOY",
+	"decoy-backend":     "TPT_DECOY_BACKEND",
+	"auth-header":       "TPT_AUTH_HEADER",
+	"auth-token":        "TPT_AUTH_TOKEN",
+	"psk":               "TPT_PSK",
+	"open-grace":        "TPT_OPEN_GRACE",
+	"linger":            "TPT_LINGER",
+	"handshake-timeout": "TPT_HANDSHAKE_TIMEOUT",
+	"max-duration":      "TPT_MAX_DURATION",
+	"stats-interval":    "TPT_STATS_INTERVAL",
+	"sni-routes":        "TPT_SNI_ROUTES",
+	"raw-remote":        "TPT_RAW_REMOTE",
+	"tunnel-magic":      "TPT_TUNNEL_MAGIC",
+	"labels":            "TPT_LABELS",
+	"backlog":           "TPT_BACKLOG",
+	"reuseport":         "TPT_REUSEPORT",
+	"shutdown-timeout":  "TPT_SHUTDOWN_TIMEOUT",
+	"max-per-ip":        "TPT_MAX_PER_IP",
+	"allow-dest":        "TPT_ALLOW_DEST",
+	"workers":           "TPT_WORKERS",
+	"queue-full":        "TPT_QUEUE_FULL",
+	"idle-timeout":      "TPT_IDLE_TIMEOUT",
+	"idle-interval":     "TPT_IDLE_INTERVAL",
+	"write-timeout":     "TPT_WRITE_TIMEOUT",
+	"transparent":       "TPT_TRANSPARENT",
+	"tproxy":            "TPT_TPROXY",
+	"max-handshakes":    "TPT_MAX_HANDSHAKES",
+	"backends-file":     "TPT_BACKENDS_FILE",
+	"breaker-failures":  "TPT_BREAKER_FAILURES",
+	"breaker-cooldown":  "TPT_BREAKER_COOLDOWN",
+	"drain-timeout":     "TPT_DRAIN_TIMEOUT",
+	"srv-refresh":       "TPT_SRV_REFRESH",
+	"log-json":          "TPT_LOG_JSON",
+	"debug":             "TPT_DEBUG",
+	"admin":             "TPT_ADMIN",
+}
+
+// applyEnv sets flags missing from the command line from their environment variables,
+// flags take precedence over the environment and the environment over the defaults
+func applyEnv() {
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	for name, env := range flagEnv {
+		value, ok := os.LookupEnv(env)
+		if !ok || set[name] {
+			continue
+		}
+		err := flag.Set(name, value)
+		if err != nil {
+			fmt.Printf("Invalid value for %s '%s'\n", env, err)
+			os.Exit(1)
+		}
+	}
+}
+
 func main() {
 	flag.Parse()
+	applyEnv()
+	if *dialIPv4 && *dialIPv6 {
+		fmt.Printf("Cannot dial IPv4 only and IPv6 only, use either -4 or -6\n")
+		return
+	}
 
 	cmdArgs := &common.CmdArgs{
 		LocalAddress:        *localAddr,
@@ -40,27 +184,56 @@ func main() {
 		ProxyKind:           *proxyKind,
 	}
 
-	config := &common.Config{
-		ServerProxyMode:     *serverProxyMode,
-		ProxyKind:           *proxyKind,
-		BufferSize:          *bufferSize,
-		LocalAddress:        *localAddr,
-		RemoteAddress:       *remoteAddr,
-		ServerHost:          *serverHost,
-		DisableServerResolv: *disableServerResolv,
-		LocalPayload:        *localPayload,
-		RemotePayload:       *remotePayload,
-		TLSEnabled:          *tlsEnabled,
-		TLSCert:             *tlsCert,
-		TLSKey:              *tlsKey,
-		SNIHost:             *sniHost,
-	}
+	config := flagConfig()
 	common.ParseConfig(config, *configFile, cmdArgs)
+	if (config.Transparent || config.TProxy) && runtime.GOOS != "linux" {
+		fmt.Printf("Transparent mode is linux only\n")
+		return
+	}
+	if config.Workers > 0 && config.QueueFull != "block" && config.QueueFull != "close" {
+		fmt.Printf("Invalid queue full policy '%s', use block or close\n", config.QueueFull)
+		return
+	}
+	if config.AllowedDestinations != "" {
+		err := proxy.CheckDestinations(strings.Split(config.AllowedDestinations, ","))
+		if err != nil {
+			fmt.Printf("Invalid allowed destinations '%s'\n", err)
+			return
+		}
+	}
 
-	var listener net.Listener
-	var err error
-	if config.TLSEnabled && config.ProxyKind != "ssh" {
-		tlsConfig := &tls.Config{
+	if config.ProxyKind == "ss" && config.SSPassword == "" {
+		fmt.Printf("Shadowsocks password required on ss proxy kind\n")
+		return
+	}
+	if config.ProxyKind == "ss" && config.SSCipher != tcp.SSCipherChacha20 {
+		fmt.Printf("Unsupported shadowsocks cipher '%s', use %s\n", config.SSCipher, tcp.SSCipherChacha20)
+		return
+	}
+
+	err := proxy.CheckTLSFingerprint(config.TLSFingerprint)
+	if err != nil {
+		fmt.Printf("Invalid tls fingerprint '%s'\n", err)
+		return
+	}
+	if config.TrojanTarget != "" {
+		err := proxy.CheckTrojanTarget(config.TrojanTarget)
+		if err != nil {
+			fmt.Printf("Invalid trojan target '%s'\n", err)
+			return
+		}
+	}
+	if config.DialSourceAddress != "" {
+		err := proxy.CheckDialSourceAddr(config.DialSourceAddress)
+		if err != nil {
+			fmt.Printf("Invalid source address '%s'\n", err)
+			return
+		}
+	}
+
+	var tlsConfig *tls.Config
+	if config.TLSEnabled && config.ProxyKind == "trojan" {
+		tlsConfig = &tls.Config{
 			InsecureSkipVerify: true,
 			ServerName:         config.SNIHost,
 		}
@@ -95,17 +268,46 @@ func main() {
 				// TODO write generated cert & private key to `server.crt`, `server.key`
 			}
 		}
-		listener, err = tls.Listen("tcp", config.LocalAddressTCP.String(), tlsConfig)
+	}
+
+	var transparentControl, reusePortControl tcp.ControlFunc
+	if config.TProxy {
+		transparentControl = tcp.ControlTransparent()
+	}
+	if config.ReusePort {
+		reusePortControl = tcp.ControlReusePort()
+	}
+	listenConfig := net.ListenConfig{
+		Control: tcp.ChainControl(transparentControl, reusePortControl),
+	}
+	listeners := make([]net.Listener, len(config.Listeners))
+	for i, l := range config.Listeners {
+		if config.ProxyKind == "udp-over-tcp" && !config.ServerProxyMode {
+			// the client side reads datagrams, each source address becomes a connection
+			pc, err := listenConfig.ListenPacket(context.Background(), "udp", l.LocalAddressTCP.String())
+			if err != nil {
+				fmt.Printf("Failed to open local port to listen: %s\n", err)
+				return
+			}
+			listeners[i] = tcp.NewUDPListener(pc, config.IdleTimeout)
+			continue
+		}
+		listener, err := listenConfig.Listen(context.Background(), "tcp", l.LocalAddressTCP.String())
 		if err != nil {
 			fmt.Printf("Failed to open local port to listen: %s\n", err)
 			return
 		}
-	} else {
-		listener, err = net.Listen("tcp", config.LocalAddressTCP.String())
-	}
-	if err != nil {
-		fmt.Printf("Failed to open local port to listen: %s\n", err)
-		return
+		if config.ListenBacklog > 0 {
+			err = tcp.SetListenBacklog(listener, config.ListenBacklog)
+			if err != nil {
+				fmt.Printf("Cannot set listen backlog '%s'\n", err)
+				return
+			}
+		}
+		if tlsConfig != nil {
+			listener = tls.NewListener(listener, tlsConfig)
+		}
+		listeners[i] = listener
 	}
 
 	fmt.Printf("Mode\t\t: %s\n", config.ProxyInfo)
@@ -115,36 +317,427 @@ func main() {
 	if config.TLSEnabled {
 		fmt.Printf("SNI Host\t: %s\n", config.SNIHost)
 	}
-	fmt.Printf("\ngo-tcp-proxy-tunnel proxing from %v to %v\n", config.LocalAddressTCP, config.RemoteAddressTCP)
 
-	handleListener(listener, config)
+	proxy.SetMaxHandshakes(config.MaxHandshakes)
+	holder := &configHolder{}
+	holder.Store(config)
+	handleReloadSignal(holder)
+
+	pools, err := setupPools(config)
+	if err != nil {
+		fmt.Printf("Cannot setup backends '%s'\n", err)
+		return
+	}
+
+	registry := proxy.NewRegistry()
+	handleDumpSignal(registry)
+	if config.IdleTimeout > 0 && config.IdleInterval > 0 {
+		startIdleReaper(registry, config.IdleInterval, config.IdleTimeout)
+	}
+	if config.AdminAddress != "" {
+		startAdminServer(config.AdminAddress, registry, pools)
+	}
+
+	var logger proxy.Logger = &proxy.TextLogger{Debug: config.Debug}
+	if config.LogJSON {
+		jsonLogger := proxy.NewJSONLogger(os.Stdout)
+		jsonLogger.Debug = config.Debug
+		logger = jsonLogger
+	}
+
+	var limiter *proxy.IPLimiter
+	if config.MaxPerIP > 0 {
+		limiter = proxy.NewIPLimiter(config.MaxPerIP)
+	}
+
+	var queue *workQueue
+	if config.Workers > 0 {
+		queue = newWorkQueue(config.Workers, config.QueueFull == "block")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	handleShutdownSignal(cancel, registry, config.ShutdownTimeout)
+
+	options := []proxy.Option{proxy.WithLogger(logger)}
+	if config.TLSEnabled {
+		options = append(options, proxy.WithSecureListener())
+	}
+
+	fmt.Println()
+	var wg sync.WaitGroup
+	var drains drainCounts
+	for i, listener := range listeners {
+		l := config.Listeners[i]
+		if config.BackendsFile != "" {
+			fmt.Printf("go-tcp-proxy-tunnel proxing from %v to backends of %s\n", l.LocalAddressTCP, config.BackendsFile)
+		} else if pools[i] != nil {
+			fmt.Printf("go-tcp-proxy-tunnel proxing from %v to %s\n", l.LocalAddressTCP, l.RemoteAddress)
+		} else {
+			fmt.Printf("go-tcp-proxy-tunnel proxing from %v to %v\n", l.LocalAddressTCP, l.RemoteAddressTCP)
+		}
+		serveConfig := proxy.Config{
+			Options: options,
+			Prepare: func(i int) func(p *proxy.Proxy, conn net.Conn) error {
+				return func(p *proxy.Proxy, conn net.Conn) error {
+					return prepareProxy(p, conn, i, pools[i], holder)
+				}
+			}(i),
+			Registry:        registry,
+			NextConnId:      nextConnId,
+			Limiter:         limiter,
+			ShutdownTimeout: config.ShutdownTimeout,
+			Drained:         drains.add,
+		}
+		if queue != nil {
+			serveConfig.Start = func(p *proxy.Proxy) bool {
+				if queue.start(p, ctx.Done()) {
+					return true
+				}
+				if ctx.Err() == nil {
+					fmt.Printf("Work queue full, closing connection from %s\n", p.Info().Client)
+				}
+				return false
+			}
+		}
+		wg.Add(1)
+		go func(listener net.Listener) {
+			defer wg.Done()
+			err := proxy.Serve(ctx, listener, serveConfig)
+			if err != nil {
+				fmt.Printf("Failed to accept connection '%s'\n", err)
+			}
+		}(listener)
+	}
+	wg.Wait()
+	if ctx.Err() != nil {
+		fmt.Printf("Shutdown complete, %d connections drained, %d closed after %s\n", drains.drained, drains.closed, config.ShutdownTimeout)
+	}
 }
 
-func handleListener(listener net.Listener, config *common.Config) {
-	var connId = uint64(0)
-	for {
-		conn, err := listener.Accept()
+// setupPools returns the backend pool of each listener, nil for listeners with a fixed remote.
+// SRV remotes and the backends file pick a target per connection from a pool refreshed in the background.
+func setupPools(config *common.Config) ([]*tcp.BackendPool, error) {
+	pools := make([]*tcp.BackendPool, len(config.Listeners))
+	if config.BackendsFile != "" {
+		pool := tcp.NewBackendPool()
+		pool.SetBreaker(config.BreakerFailures, config.BreakerCooldown)
+		pool.SetDrainTimeout(config.DrainTimeout)
+		err := pool.WatchFile(config.BackendsFile)
 		if err != nil {
-			fmt.Printf("Failed to accept connection '%s'\n", err)
-			return
+			return nil, fmt.Errorf("cannot read backends file, %s", err)
+		}
+		for i := range pools {
+			pools[i] = pool
+		}
+	}
+	for i, l := range config.Listeners {
+		if pools[i] != nil || !tcp.IsSRVName(l.RemoteAddress) {
+			continue
+		}
+		pools[i] = tcp.NewBackendPool()
+		pools[i].SetBreaker(config.BreakerFailures, config.BreakerCooldown)
+		pools[i].SetDrainTimeout(config.DrainTimeout)
+		err := pools[i].WatchSRV(l.RemoteAddress, config.SRVRefresh)
+		if err != nil {
+			return nil, fmt.Errorf("cannot lookup SRV record, %s", err)
+		}
+	}
+	return pools, nil
+}
+
+// connId is shared by all listeners so ids stay unique across ports
+var connId uint64
+
+func nextConnId() uint64 {
+	return atomic.AddUint64(&connId, 1)
+}
+
+// configHolder keeps the config applied to new connections, it is swapped on reload
+type configHolder struct {
+	v atomic.Value
+}
+
+func (h *configHolder) Load() *common.Config {
+	return h.v.Load().(*common.Config)
+}
+
+func (h *configHolder) Store(config *common.Config) {
+	h.v.Store(config)
+}
+
+// reloadConfig applies the config file again for new connections, existing connections keep their settings
+func reloadConfig(holder *configHolder) {
+	current := holder.Load()
+	config := flagConfig()
+	err := common.ReloadConfig(config, *configFile, current)
+	if err != nil {
+		fmt.Printf("Cannot reload config, %s\n", err)
+		return
+	}
+	for _, name := range common.KeepFields(config, current, restartFields(current, config)) {
+		fmt.Printf("Config reload cannot change %s, restart to apply\n", name)
+	}
+	changes := common.ConfigChanges(current, config)
+	if len(changes) == 0 {
+		fmt.Printf("Config reloaded, nothing changed\n")
+	}
+	for _, change := range changes {
+		fmt.Printf("Config reloaded, %s\n", change)
+	}
+	if config.MaxHandshakes != current.MaxHandshakes {
+		proxy.SetMaxHandshakes(config.MaxHandshakes)
+	}
+	holder.Store(config)
+}
+
+// restartFields lists the fields only read at startup, a reload keeps their running values
+func restartFields(current, config *common.Config) []string {
+	fields := []string{"Workers", "QueueFull", "MaxPerIP", "LogJSON", "Debug", "AdminAddress", "TLSCert", "TLSKey",
+		"TProxy", "ReusePort", "ListenBacklog", "IdleTimeout", "IdleInterval", "ShutdownTimeout", "BackendsFile",
+		"SRVRefresh", "BreakerFailures", "BreakerCooldown", "DrainTimeout"}
+	// the listeners are udp sockets for udp-over-tcp clients and tls sockets for tls servers
+	if udpListener(current) != udpListener(config) {
+		fields = append(fields, "ProxyKind", "ServerProxyMode", "ProxyInfo")
+	}
+	if current.ServerProxyMode || config.ServerProxyMode {
+		fields = append(fields, "TLSEnabled")
+	}
+	// backend pools are set up for the remote addresses at startup
+	pooled := current.BackendsFile != ""
+	for _, l := range current.Listeners {
+		pooled = pooled || tcp.IsSRVName(l.RemoteAddress)
+	}
+	if pooled {
+		fields = append(fields, "RemoteAddress", "Listeners", "RemoteAddressTCP")
+	}
+	return fields
+}
+
+func udpListener(config *common.Config) bool {
+	return config.ProxyKind == "udp-over-tcp" && !config.ServerProxyMode
+}
+
+// flagConfig builds the config from the command line flags, the config file is applied on top by ParseConfig
+func flagConfig() *common.Config {
+	dialNetwork := "tcp"
+	if *dialIPv4 {
+		dialNetwork = "tcp4"
+	}
+	if *dialIPv6 {
+		dialNetwork = "tcp6"
+	}
+
+	return &common.Config{
+		ServerProxyMode:     *serverProxyMode,
+		ProxyKind:           *proxyKind,
+		BufferSize:          *bufferSize,
+		LocalAddress:        *localAddr,
+		RemoteAddress:       *remoteAddr,
+		ServerHost:          *serverHost,
+		DisableServerResolv: *disableServerResolv,
+		LocalPayload:        *localPayload,
+		RemotePayload:       *remotePayload,
+		TLSEnabled:          *tlsEnabled,
+		TLSCert:             *tlsCert,
+		TLSKey:              *tlsKey,
+		SNIHost:             *sniHost,
+		LogJSON:             *logJSON,
+		Debug:               *debug,
+		AdminAddress:        *adminAddr,
+		WSPath:              *wsPath,
+		WSHost:              *wsHost,
+		DialNetwork:         dialNetwork,
+		DialSourceAddress:   *dialSourceAddr,
+		FwMark:              *fwMark,
+		DecoyFile:           *decoyFile,
+		DecoyBackend:        *decoyBackend,
+		AuthHeader:          *authHeader,
+		AuthToken:           *authToken,
+		PSK:                 *psk,
+		OpenGracePeriod:     *openGracePeriod,
+		HandshakeTimeout:    *handshakeTimeout,
+		TLSFingerprint:      *tlsFingerprint,
+		Linger:              *linger,
+		WriteTimeout:        *writeTimeout,
+		MaxConnDuration:     *maxConnDuration,
+		StatsInterval:       *statsInterval,
+		SNIRoutes:           *sniRoutes,
+		RawRemote:           *rawRemote,
+		TunnelMagic:         *tunnelMagic,
+		Labels:              *labels,
+		TrojanPassword:      *trojanPassword,
+		TrojanTarget:        *trojanTarget,
+		SSPassword:          *ssPassword,
+		SSCipher:            *ssCipher,
+		Bidirectional:       *bidirectional,
+		ListenBacklog:       *listenBacklog,
+		ReusePort:           *reusePort,
+		ShutdownTimeout:     *shutdownTimeout,
+		MaxPerIP:            *maxPerIP,
+		AllowedDestinations: *allowDestinations,
+		Workers:             *workers,
+		QueueFull:           *queueFull,
+		IdleTimeout:         *idleTimeout,
+		IdleInterval:        *idleInterval,
+		Transparent:         *transparent,
+		TProxy:              *tproxy,
+		MaxHandshakes:       *maxHandshakes,
+		SRVRefresh:          *srvRefresh,
+		BackendsFile:        *backendsFile,
+		BreakerFailures:     *breakerFailures,
+		BreakerCooldown:     *breakerCooldown,
+		DrainTimeout:        *drainTimeout,
+	}
+}
+
+// prepareProxy applies config.Listeners[index] of the current config to the proxy of conn, pool picks the remote
+// when set
+func prepareProxy(p *proxy.Proxy, conn net.Conn, index int, pool *tcp.BackendPool, holder *configHolder) error {
+	config := holder.Load()
+	l := config.Listeners[index]
+	var dst *net.TCPAddr
+	var backend string
+	var err error
+	if pool != nil {
+		backend, dst, err = pickBackend(pool, config.DialNetwork)
+		if err != nil {
+			return fmt.Errorf("cannot pick backend, %s", err)
+		}
+	}
+	if config.Transparent {
+		dst, err = tcp.OriginalDst(conn)
+		if err != nil {
+			return fmt.Errorf("cannot read original destination of %s, %s", conn.RemoteAddr(), err)
 		}
-		connId += 1
+	}
+	if config.TProxy {
+		// TPROXY keeps the original destination as the local address of the accepted socket
+		dst, _ = conn.LocalAddr().(*net.TCPAddr)
+		if dst != nil && dst.Port == l.LocalAddressTCP.Port {
+			return fmt.Errorf("cannot read original destination of %s, connection was not redirected", conn.RemoteAddr())
+		}
+	}
+	if dst != nil {
+		l.RemoteAddress = dst.String()
+		l.RemoteAddressTCP = dst
+	}
 
-		p := proxy.NewProxy(connId, conn, config.LocalAddressTCP, config.RemoteAddressTCP, config.TLSEnabled)
-		if config.ServerHost != "" {
-			p.SetServerHost(config.ServerHost)
+	p.SetRemoteAddr(l.RemoteAddressTCP)
+	p.SetOnClose(closedConns.observe)
+	p.SetRemoteHost(l.RemoteAddress)
+	if config.ServerHost != "" {
+		p.SetServerHost(config.ServerHost)
+	}
+	if config.BufferSize > 0 {
+		p.SetBufferSize(config.BufferSize)
+	}
+	if config.TLSEnabled {
+		p.SetEnableTLS(config.TLSEnabled)
+		p.SetSNIHost(config.SNIHost)
+	}
+	p.SetlPayload(config.LocalPayload)
+	p.SetrPayload(config.RemotePayload)
+	p.SetServerProxyMode(config.ServerProxyMode)
+	p.SetBidirectional(config.Bidirectional)
+	p.SetProxyKind(config.ProxyKind)
+	p.SetWSPath(config.WSPath)
+	if config.WSHost != "" {
+		p.SetWSHost(config.WSHost)
+	}
+	p.SetDialNetwork(config.DialNetwork)
+	if config.DialSourceAddress != "" {
+		err = p.SetDialSourceAddr(config.DialSourceAddress)
+		if err != nil {
+			return fmt.Errorf("invalid source address, %s", err)
+		}
+	}
+	p.SetFwMark(config.FwMark)
+	p.SetTProxy(config.TProxy)
+	if config.DecoyResponse != nil {
+		p.SetDecoyResponse(config.DecoyResponse)
+	}
+	p.SetDecoyBackend(config.DecoyBackend)
+	p.SetAuthToken(config.AuthHeader, config.AuthToken)
+	if config.PSK != "" {
+		p.SetPSK([]byte(config.PSK))
+	}
+	p.SetOpenGracePeriod(config.OpenGracePeriod)
+	p.SetHandshakeTimeout(config.HandshakeTimeout)
+	p.SetLinger(config.Linger)
+	p.SetWriteTimeout(config.WriteTimeout)
+	p.SetMaxConnDuration(config.MaxConnDuration)
+	p.SetStatsInterval(config.StatsInterval)
+	if len(config.LabelMap) > 0 {
+		p.SetLabels(config.LabelMap)
+	}
+	if len(config.SNIRouteMap) > 0 {
+		p.SetSNIRoutes(config.SNIRouteMap)
+	}
+	if config.RawRemote != "" {
+		p.SetProtocolSniffer(proxy.ProtocolSniffer{
+			Magic:   []byte(config.TunnelMagic),
+			Raw:     config.RawRemote,
+			Timeout: sniffTimeout,
+		})
+	}
+	if config.TLSFingerprint != "" {
+		err = p.SetTLSFingerprint(config.TLSFingerprint)
+		if err != nil {
+			return fmt.Errorf("invalid tls fingerprint, %s", err)
+		}
+	}
+	if config.TrojanPassword != "" {
+		p.SetTrojanPassword(config.TrojanPassword)
+	}
+	if config.TrojanTarget != "" {
+		err = p.SetTrojanTarget(config.TrojanTarget)
+		if err != nil {
+			return fmt.Errorf("invalid trojan target, %s", err)
+		}
+	}
+	if config.ProxyKind == "ss" {
+		err = p.SetSSCipher(config.SSCipher)
+		if err == nil {
+			err = p.SetSSKey(proxy.SSPasswordKey(config.SSPassword))
 		}
-		if config.BufferSize > 0 {
-			p.SetBufferSize(config.BufferSize)
+		if err != nil {
+			return fmt.Errorf("invalid shadowsocks config, %s", err)
 		}
-		if config.TLSEnabled {
-			p.SetEnableTLS(config.TLSEnabled)
-			p.SetSNIHost(config.SNIHost)
+	}
+	if config.AllowedDestinations != "" {
+		err = p.SetAllowedDestinations(strings.Split(config.AllowedDestinations, ","))
+		if err != nil {
+			return fmt.Errorf("invalid allowed destinations, %s", err)
 		}
-		p.SetlPayload(config.LocalPayload)
-		p.SetrPayload(config.RemotePayload)
-		p.SetServerProxyMode(config.ServerProxyMode)
-		p.SetProxyKind(config.ProxyKind)
-		go p.Start()
 	}
+
+	// Serve closes Done of proxies it does not start, the backend is released either way
+	if backend != "" && !config.Transparent && !config.TProxy {
+		p.SetOnDial(func(err error) {
+			pool.Report(backend, err)
+		})
+		untrack := pool.Track(backend, p.Close)
+		go func() {
+			<-p.Done()
+			untrack()
+		}()
+	}
+	return nil
+}
+
+// connections sending nothing for this period after -raw-remote sniffing starts are forwarded raw
+const sniffTimeout = 2 * time.Second
+
+func pickBackend(pool *tcp.BackendPool, network string) (string, *net.TCPAddr, error) {
+	address, err := pool.Pick()
+	if err != nil {
+		return "", nil, err
+	}
+	addr, err := net.ResolveTCPAddr(network, address)
+	if err != nil {
+		pool.Report(address, err)
+		return "", nil, err
+	}
+	return address, addr, nil
 }
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"fmt"
+	"github.com/lutfailham96/go-tcp-proxy-tunnel/pkg/proxy"
+	"time"
+)
+
+// startIdleReaper closes registered connections that forwarded no bytes for idle, checked every interval.
+// It backs up per connection timeouts.
+func startIdleReaper(registry *proxy.Registry, interval, idle time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for now := range ticker.C {
+			for _, info := range registry.List() {
+				idleFor := now.Sub(info.LastActivity)
+				if idleFor < idle {
+					continue
+				}
+				if p := registry.Get(info.Id); p != nil {
+					fmt.Printf("Closing idle connection #%d, no bytes transferred for %s\n", info.Id, idleFor.Round(time.Second))
+					p.Close()
+				}
+			}
+		}
+	}()
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/lutfailham96/go-tcp-proxy-tunnel/pkg/proxy"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// stop accepting connections on SIGTERM, every Serve drains its active connections for up to timeout and returns
+func handleShutdownSignal(cancel context.CancelFunc, registry *proxy.Registry, timeout time.Duration) {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGTERM)
+	go func() {
+		<-sigCh
+		fmt.Printf("Shutting down, draining %d connections for up to %s\n", registry.Len(), timeout)
+		cancel()
+	}()
+}
+
+// drainCounts sums the connections every Serve drained or closed on shutdown
+type drainCounts struct {
+	drained uint64
+	closed  uint64
+}
+
+func (d *drainCounts) add(drained, closed int) {
+	atomic.AddUint64(&d.drained, uint64(drained))
+	atomic.AddUint64(&d.closed, uint64(closed))
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"github.com/lutfailham96/go-tcp-proxy-tunnel/pkg/proxy"
+)
+
+// workQueue runs proxies on a fixed number of workers, at most as many proxies as workers wait in the queue
+type workQueue struct {
+	slots chan struct{}
+	jobs  chan *proxy.Proxy
+	block bool
+}
+
+func newWorkQueue(workers int, block bool) *workQueue {
+	q := &workQueue{
+		slots: make(chan struct{}, workers),
+		jobs:  make(chan *proxy.Proxy, workers),
+		block: block,
+	}
+	for i := 0; i < workers; i++ {
+		go q.work()
+	}
+	return q
+}
+
+// start queues p on the workers, it waits for a place when blocking and reports false when the queue is full
+// otherwise or stop is closed while waiting
+func (q *workQueue) start(p *proxy.Proxy, stop <-chan struct{}) bool {
+	if q.block {
+		select {
+		case q.slots <- struct{}{}:
+		case <-stop:
+			return false
+		}
+	} else {
+		select {
+		case q.slots <- struct{}{}:
+		default:
+			return false
+		}
+	}
+	q.jobs <- p
+	return true
+}
+
+func (q *workQueue) work() {
+	for p := range q.jobs {
+		<-q.slots
+		p.Start()
+	}
+}
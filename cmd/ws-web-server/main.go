@@ -1,25 +1,59 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"flag"
 	"fmt"
 	"github.com/lutfailham96/go-tcp-proxy-tunnel/internal/tcp"
 	"github.com/lutfailham96/go-tcp-proxy-tunnel/internal/util"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
 	"net"
 	"os"
+	"os/signal"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 )
 
 var (
-	httpAddress    = flag.String("l", "0.0.0.0:80", "http listen address")
-	httpsAddress   = flag.String("ln", "0.0.0.0:443", "https listen address")
-	tlsCert        = flag.String("cert", "", "tls cert pem")
-	tlsKey         = flag.String("key", "", "tls key pem")
-	backendAddress = flag.String("b", "127.0.0.1:8082", "backend proxy address")
-	trojanAddress  = flag.String("t", "127.0.0.1:433", "trojan backend address")
-	trojanWsPath   = flag.String("tp", "/ws-trojan", "trojan websocket path")
-	sni            = flag.String("sni", "", "server name identification")
+	httpAddress     = flag.String("l", "0.0.0.0:80", "http listen address")
+	httpsAddress    = flag.String("ln", "0.0.0.0:443", "https listen address")
+	tlsCert         = flag.String("cert", "", "tls cert pem")
+	tlsKey          = flag.String("key", "", "tls key pem")
+	backendAddress  = flag.String("b", "127.0.0.1:8082", "backend proxy address")
+	trojanAddress   = flag.String("t", "127.0.0.1:433", "trojan backend address")
+	trojanWsPath    = flag.String("tp", "/ws-trojan", "trojan websocket path")
+	sni             = flag.String("sni", "", "server name identification")
+	acmeDomains     = flag.String("acme-domains", "", "comma separated domains to request ACME (Let's Encrypt) certificates for")
+	acmeCache       = flag.String("acme-cache", "acme-cache", "ACME certificate cache directory")
+	certCache       = flag.String("cert-cache", "", "directory to keep the generated self-signed certificate across restarts")
+	allowedOrigins  = flag.String("allowed-origins", "", "comma separated websocket origins to accept, empty accepts any origin")
+	allowedBackends = flag.String("allowed-backends", "", "comma separated host:port backends clients may select with the X-Backend-Target header")
+	rate            = flag.Float64("rate", 0, "new connections per second allowed for each client ip, health checks are not counted, 0 disables the limit")
+	maxPerIP        = flag.Int("max-per-ip", 0, "concurrent connections allowed for each client ip, health checks are not counted, 0 disables the limit")
+	backendProxy    = flag.Bool("backend-proxy-proto", false, "send a PROXY protocol v1 header with the client address to the backend")
+	backendTimeout  = flag.Duration("backend-timeout", 5*time.Second, "backend dial timeout")
+	backendPool     = flag.Int("backend-pool", 0, "idle pre-dialed connections to keep for each backend, 0 disables pooling")
+	wsDeflate       = flag.Bool("deflate", false, "negotiate permessage-deflate with clients, costs cpu for every message")
+	maxConns        = flag.Int("max-conns", 0, "concurrent websocket tunnels allowed, 0 disables the limit")
+	backendH2       = flag.Bool("backend-h2", false, "open websockets to TLS backends over HTTP/2 extended CONNECT when supported")
+	shutdownTimeout = flag.Duration("shutdown-timeout", 30*time.Second, "period open sessions get to finish on SIGTERM before the server exits")
+)
+
+var (
+	limiter *tcp.IPLimiter
+	pool    *tcp.ConnPool
+	tunnels *tcp.TunnelLimit
+)
+
+// sessions tracks the running forwarders so a shutdown can wait for them
+var (
+	sessions     sync.WaitGroup
+	sessionCount int64
 )
 
 func main() {
@@ -30,36 +64,69 @@ func main() {
 		os.Exit(1)
 	}
 
+	if *rate > 0 || *maxPerIP > 0 {
+		limiter = tcp.NewIPLimiter(*rate, *maxPerIP)
+	}
+
+	if *backendPool > 0 {
+		pool = tcp.NewConnPool(*backendPool, *backendTimeout)
+	}
+
+	tunnels = tcp.NewTunnelLimit(*maxConns)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGTERM)
+	go func() {
+		<-sigCh
+		fmt.Printf("Shutting down, draining %d sessions for up to %s\n", atomic.LoadInt64(&sessionCount), *shutdownTimeout)
+		cancel()
+	}()
+
 	var tcpWg sync.WaitGroup
 
 	tcpWg.Add(2)
 	fmt.Printf("SNI:\t\t\t%s\n", *sni)
-	go setupTcpListener(false)
-	go setupTcpListener(true)
+	go setupTcpListener(ctx, &tcpWg, false)
+	go setupTcpListener(ctx, &tcpWg, true)
 
 	tcpWg.Wait()
+	if ctx.Err() != nil {
+		drainSessions(*shutdownTimeout)
+	}
+}
+
+// drainSessions waits up to timeout for the open sessions, the ones left are closed when the process exits
+func drainSessions(timeout time.Duration) {
+	open := atomic.LoadInt64(&sessionCount)
+	done := make(chan struct{})
+	go func() {
+		sessions.Wait()
+		close(done)
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+	case <-timer.C:
+	}
+	left := atomic.LoadInt64(&sessionCount)
+	fmt.Printf("Shutdown complete, %d sessions drained, %d closed after %s\n", open-left, left, timeout)
 }
 
-func setupTcpListener(secure bool) {
+// setupTcpListener accepts until ctx is cancelled, temporary accept errors are retried with the backoff of
+// proxy.Serve. Sessions run on WebForwarder instead of proxy.Serve, they are http and websocket aware.
+func setupTcpListener(ctx context.Context, tcpWg *sync.WaitGroup, secure bool) {
+	defer tcpWg.Done()
+
 	var ln net.Listener
 	var err error
 
 	if secure {
 		var tlsConfig *tls.Config
-		if *tlsCert != "" && *tlsKey != "" {
-			cer, err := tls.LoadX509KeyPair(*tlsCert, *tlsKey)
-			if err != nil {
-				fmt.Printf("Cannot read tls key pair '%s'\n", err)
-			}
-			tlsConfig = &tls.Config{
-				InsecureSkipVerify: true,
-				Certificates:       []tls.Certificate{cer},
-			}
-		} else {
-			tlsConfig, _, err = util.TLSGenerateConfig()
-			if err != nil {
-				fmt.Printf("Cannot setup tls certificates '%s'\n", err)
-			}
+		tlsConfig, err = tlsConfigSetup()
+		if err != nil {
+			fmt.Printf("Cannot setup tls certificates '%s'\n", err)
 		}
 		tcp.ResolveAddr(*httpsAddress)
 		ln, err = tls.Listen("tcp", *httpsAddress, tlsConfig)
@@ -74,18 +141,105 @@ func setupTcpListener(secure bool) {
 		return
 	}
 
+	origins := splitList(*allowedOrigins)
+	backends := splitList(*allowedBackends)
+
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+
 	connId := uint64(0)
+	var acceptDelay time.Duration
 	for {
 		src, err := ln.Accept()
 		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
 			fmt.Printf("Cannot accept connection '%s'\n", err)
+			if !tcp.IsTemporary(err) {
+				return
+			}
+			acceptDelay = tcp.NextAcceptDelay(acceptDelay)
+			time.Sleep(acceptDelay)
 			continue
 		}
+		acceptDelay = 0
 		connId += 1
 		fwd := tcp.NewWebForwarder(connId, src, secure)
 		fwd.SetDstAddress(*backendAddress)
 		fwd.SetTrjConfig(*trojanAddress, *trojanWsPath)
 		fwd.SetSNI(*sni)
-		go fwd.Start()
+		fwd.SetBackendH2(*backendH2)
+		fwd.SetProxyProtocol(*backendProxy)
+		fwd.SetDialTimeout(*backendTimeout)
+		fwd.SetAllowedOrigins(origins)
+		fwd.SetAllowedBackends(backends)
+		fwd.SetLimiter(limiter)
+		fwd.SetConnPool(pool)
+		fwd.SetDeflate(*wsDeflate)
+		fwd.SetTunnelLimit(tunnels)
+		sessions.Add(1)
+		atomic.AddInt64(&sessionCount, 1)
+		go func() {
+			defer sessions.Done()
+			defer atomic.AddInt64(&sessionCount, -1)
+			fwd.Start()
+		}()
+	}
+}
+
+func tlsConfigSetup() (*tls.Config, error) {
+	if *tlsCert != "" && *tlsKey != "" {
+		cer, err := tls.LoadX509KeyPair(*tlsCert, *tlsKey)
+		if err != nil {
+			fmt.Printf("Cannot read tls key pair '%s'\n", err)
+		}
+		tlsConfig := &tls.Config{
+			InsecureSkipVerify: true,
+			Certificates:       []tls.Certificate{cer},
+		}
+		stapler, err := util.NewOCSPStapler(cer)
+		if err != nil {
+			fmt.Printf("OCSP stapling disabled '%s'\n", err)
+			return tlsConfig, nil
+		}
+		stapler.Start()
+		tlsConfig.Certificates = nil
+		tlsConfig.GetCertificate = stapler.GetCertificate
+		return tlsConfig, nil
+	}
+
+	if *acmeDomains != "" {
+		domains := splitList(*acmeDomains)
+		fmt.Printf("ACME domains:\t\t%s\n", strings.Join(domains, ", "))
+		m := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(domains...),
+			Cache:      autocert.DirCache(*acmeCache),
+		}
+		// certificates are obtained through the tls-alpn-01 challenge on the https listener
+		return &tls.Config{
+			GetCertificate: m.GetCertificate,
+			NextProtos:     []string{"http/1.1", acme.ALPNProto},
+		}, nil
+	}
+
+	if *certCache != "" {
+		return util.TLSCachedConfig(*certCache, *sni)
+	}
+	tlsConfig, _, err := util.TLSGenerateConfig(*sni)
+	return tlsConfig, err
+}
+
+func splitList(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			list = append(list, item)
+		}
 	}
+	return list
 }
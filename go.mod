@@ -1,3 +1,9 @@
 module github.com/lutfailham96/go-tcp-proxy-tunnel
 
 go 1.13
+
+require (
+	github.com/refraction-networking/utls v1.0.0
+	golang.org/x/crypto v0.0.0-20201221181555-eec23a3978ad
+	golang.org/x/net v0.0.0-20210226172049-e18ecbb05110
+)
@@ -4,8 +4,13 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/lutfailham96/go-tcp-proxy-tunnel/internal/tcp"
+	"io/ioutil"
 	"net"
 	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type Config struct {
@@ -17,6 +22,7 @@ type Config struct {
 	RemoteAddress       string
 	LocalAddressTCP     *net.TCPAddr
 	RemoteAddressTCP    *net.TCPAddr
+	Listeners           []Listener `json:"-"`
 	ServerHost          string
 	DisableServerResolv bool
 	ConnectionInfo      string
@@ -26,6 +32,63 @@ type Config struct {
 	SNIHost             string
 	LocalPayload        string
 	RemotePayload       string
+	LogJSON             bool
+	Debug               bool
+	AdminAddress        string
+	WSPath              string
+	WSHost              string
+	DialNetwork         string
+	DialSourceAddress   string
+	FwMark              int
+	DecoyFile           string
+	DecoyResponse       []byte `json:"-"`
+	DecoyBackend        string
+	AuthHeader          string
+	AuthToken           string
+	PSK                 string
+	OpenGracePeriod     time.Duration
+	WriteTimeout        time.Duration
+	MaxConnDuration     time.Duration
+	StatsInterval       time.Duration
+	Transparent         bool
+	TProxy              bool
+	MaxHandshakes       int
+	SRVRefresh          time.Duration
+	BackendsFile        string
+	BreakerFailures     int
+	BreakerCooldown     time.Duration
+	DrainTimeout        time.Duration
+	SNIRoutes           string
+	ListenBacklog       int
+	ReusePort           bool
+	ShutdownTimeout     time.Duration
+	MaxPerIP            int
+	AllowedDestinations string
+	Workers             int
+	QueueFull           string
+	IdleTimeout         time.Duration
+	IdleInterval        time.Duration
+	SNIRouteMap         map[string]string `json:"-"`
+	RawRemote           string
+	TunnelMagic         string
+	Labels              string
+	LabelMap            map[string]string `json:"-"`
+	TrojanPassword      string
+	TrojanTarget        string
+	SSPassword          string
+	SSCipher            string
+	Bidirectional       bool
+	HandshakeTimeout    time.Duration
+	TLSFingerprint      string
+	Linger              int
+}
+
+// Listener pairs a local address with the remote address its connections are forwarded to
+type Listener struct {
+	LocalAddress     string
+	RemoteAddress    string
+	LocalAddressTCP  *net.TCPAddr
+	RemoteAddressTCP *net.TCPAddr
 }
 
 type CmdArgs struct {
@@ -54,13 +117,23 @@ func ParseConfig(config *Config, configFile string, cmdArgs *CmdArgs) {
 	if config.LocalAddress != "" {
 		localAddress = config.LocalAddress
 	}
-	config.LocalAddressTCP = tcp.ResolveAddr(localAddress)
 
 	remoteAddress := cmdArgs.RemoteAddress
 	if config.RemoteAddress != "" {
 		remoteAddress = config.RemoteAddress
 	}
-	config.RemoteAddressTCP = tcp.ResolveAddr(remoteAddress)
+	if config.DialNetwork == "" {
+		config.DialNetwork = "tcp"
+	}
+	listeners, err := ParseListeners(config.DialNetwork, localAddress, remoteAddress)
+	if err != nil {
+		fmt.Printf("Cannot parse listen addresses '%s'\n", err)
+		os.Exit(1)
+		return
+	}
+	config.Listeners = listeners
+	config.LocalAddressTCP = listeners[0].LocalAddressTCP
+	config.RemoteAddressTCP = listeners[0].RemoteAddressTCP
 
 	serverHostAddr := cmdArgs.ServerHost
 	if config.ServerHost != "" {
@@ -70,6 +143,38 @@ func ParseConfig(config *Config, configFile string, cmdArgs *CmdArgs) {
 		tcp.ResolveAddr(serverHostAddr)
 	}
 
+	if config.DialSourceAddress != "" {
+		tcp.ValidateSourceAddr(config.DialSourceAddress)
+	}
+
+	if config.SNIRoutes != "" {
+		config.SNIRouteMap, err = ParseSNIRoutes(config.SNIRoutes)
+		if err != nil {
+			fmt.Printf("Cannot parse SNI routes '%s'\n", err)
+			os.Exit(1)
+			return
+		}
+	}
+
+	if config.Labels != "" {
+		config.LabelMap, err = ParseLabels(config.Labels)
+		if err != nil {
+			fmt.Printf("Cannot parse labels '%s'\n", err)
+			os.Exit(1)
+			return
+		}
+	}
+
+	if config.DecoyFile != "" {
+		decoyResponse, err := ioutil.ReadFile(config.DecoyFile)
+		if err != nil {
+			fmt.Printf("Cannot read decoy response file '%s'\n", err)
+			os.Exit(1)
+			return
+		}
+		config.DecoyResponse = decoyResponse
+	}
+
 	config.ConnectionInfo = "insecure"
 	if config.TLSEnabled {
 		if config.SNIHost == "" {
@@ -108,3 +213,248 @@ func loadConfigFile(cfgFile string, cfg *Config) {
 		}
 	}
 }
+
+// ReloadConfig loads configFile over config like ParseConfig but reports errors instead of exiting,
+// the listen address cannot change on a running listener and is kept from current
+func ReloadConfig(config *Config, configFile string, current *Config) error {
+	if configFile != "" {
+		file, err := os.Open(configFile)
+		if err != nil {
+			return fmt.Errorf("cannot open file '%s'", err)
+		}
+		defer file.Close()
+		err = json.NewDecoder(file).Decode(config)
+		if err != nil {
+			return fmt.Errorf("cannot decode config file '%s'", err)
+		}
+	}
+
+	config.LocalAddress = current.LocalAddress
+	if config.DialNetwork == "" {
+		config.DialNetwork = "tcp"
+	}
+	listeners, err := ParseListeners(config.DialNetwork, config.LocalAddress, config.RemoteAddress)
+	if err != nil {
+		return fmt.Errorf("cannot parse listen addresses '%s'", err)
+	}
+	config.Listeners = listeners
+	config.LocalAddressTCP = listeners[0].LocalAddressTCP
+	config.RemoteAddressTCP = listeners[0].RemoteAddressTCP
+
+	if config.SNIRoutes != "" {
+		config.SNIRouteMap, err = ParseSNIRoutes(config.SNIRoutes)
+		if err != nil {
+			return fmt.Errorf("cannot parse SNI routes '%s'", err)
+		}
+	}
+
+	if config.Labels != "" {
+		config.LabelMap, err = ParseLabels(config.Labels)
+		if err != nil {
+			return fmt.Errorf("cannot parse labels '%s'", err)
+		}
+	}
+
+	if config.DecoyFile != "" {
+		decoyResponse, err := ioutil.ReadFile(config.DecoyFile)
+		if err != nil {
+			return fmt.Errorf("cannot read decoy response file '%s'", err)
+		}
+		config.DecoyResponse = decoyResponse
+	}
+
+	config.ConnectionInfo = "insecure"
+	if config.TLSEnabled {
+		if config.SNIHost == "" {
+			return fmt.Errorf("SNI hostname required on secure connection")
+		}
+		config.ConnectionInfo = "secure (TLS)"
+	}
+
+	config.setDefaults()
+	return nil
+}
+
+// ParseSNIRoutes parses comma separated name=address routes, name may be a *.example.com wildcard or *
+func ParseSNIRoutes(s string) (map[string]string, error) {
+	routes := make(map[string]string)
+	for _, route := range strings.Split(s, ",") {
+		route = strings.TrimSpace(route)
+		if route == "" {
+			continue
+		}
+		i := strings.IndexByte(route, '=')
+		if i <= 0 {
+			return nil, fmt.Errorf("route '%s' is not name=address", route)
+		}
+		name := strings.ToLower(strings.TrimSpace(route[:i]))
+		address := strings.TrimSpace(route[i+1:])
+		_, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+		routes[name] = address
+	}
+	return routes, nil
+}
+
+// ParseLabels parses comma separated key=value labels
+func ParseLabels(s string) (map[string]string, error) {
+	labels := make(map[string]string)
+	for _, label := range strings.Split(s, ",") {
+		label = strings.TrimSpace(label)
+		if label == "" {
+			continue
+		}
+		i := strings.IndexByte(label, '=')
+		if i <= 0 {
+			return nil, fmt.Errorf("label '%s' is not key=value", label)
+		}
+		labels[strings.TrimSpace(label[:i])] = strings.TrimSpace(label[i+1:])
+	}
+	return labels, nil
+}
+
+// maxPortRange caps the number of ports a single host:first-last range opens
+const maxPortRange = 1024
+
+// ParseListeners pairs the comma separated local addresses with the remote addresses,
+// a single remote address is shared by every local address, port ranges like host:8000-8010 expand to one address per port.
+// A remote may be an SRV name, RemoteAddressTCP is then its preferred target at parse time.
+func ParseListeners(network, localAddress, remoteAddress string) ([]Listener, error) {
+	locals, err := splitAddresses(localAddress)
+	if err != nil {
+		return nil, err
+	}
+	remotes, err := splitAddresses(remoteAddress)
+	if err != nil {
+		return nil, err
+	}
+	if len(locals) == 0 || len(remotes) == 0 {
+		return nil, fmt.Errorf("host address is not valid or empty")
+	}
+	if len(remotes) != 1 && len(remotes) != len(locals) {
+		return nil, fmt.Errorf("got %d remote addresses for %d local addresses", len(remotes), len(locals))
+	}
+
+	listeners := make([]Listener, len(locals))
+	for i, local := range locals {
+		remote := remotes[0]
+		if len(remotes) > 1 {
+			remote = remotes[i]
+		}
+		localTCP, err := net.ResolveTCPAddr("tcp", local)
+		if err != nil {
+			return nil, err
+		}
+		remoteTCP, err := resolveRemote(network, remote)
+		if err != nil {
+			return nil, err
+		}
+		listeners[i] = Listener{
+			LocalAddress:     local,
+			RemoteAddress:    remote,
+			LocalAddressTCP:  localTCP,
+			RemoteAddressTCP: remoteTCP,
+		}
+	}
+	return listeners, nil
+}
+
+// resolveRemote resolves a remote address, an SRV name resolves to its preferred target
+func resolveRemote(network, remote string) (*net.TCPAddr, error) {
+	if !tcp.IsSRVName(remote) {
+		return net.ResolveTCPAddr(network, remote)
+	}
+	targets, err := tcp.LookupSRV(remote)
+	if err != nil {
+		return nil, err
+	}
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("SRV record %s has no targets", remote)
+	}
+	return net.ResolveTCPAddr(network, targets[0].Address)
+}
+
+func splitAddresses(s string) ([]string, error) {
+	var addresses []string
+	for _, address := range strings.Split(s, ",") {
+		address = strings.TrimSpace(address)
+		if address == "" {
+			continue
+		}
+		expanded, err := expandPortRange(address)
+		if err != nil {
+			return nil, err
+		}
+		addresses = append(addresses, expanded...)
+	}
+	return addresses, nil
+}
+
+func expandPortRange(address string) ([]string, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil || !strings.Contains(port, "-") {
+		return []string{address}, nil
+	}
+	bounds := strings.SplitN(port, "-", 2)
+	first, err := strconv.Atoi(bounds[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid port range %s", address)
+	}
+	last, err := strconv.Atoi(bounds[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid port range %s", address)
+	}
+	if first < 1 || last > 65535 || first > last {
+		return nil, fmt.Errorf("invalid port range %s", address)
+	}
+	if last-first+1 > maxPortRange {
+		return nil, fmt.Errorf("port range %s opens more than %d ports", address, maxPortRange)
+	}
+
+	addresses := make([]string, 0, last-first+1)
+	for p := first; p <= last; p++ {
+		addresses = append(addresses, net.JoinHostPort(host, strconv.Itoa(p)))
+	}
+	return addresses, nil
+}
+
+// ConfigChanges lists the fields that differ between old and new, secrets are not printed
+func ConfigChanges(old, new *Config) []string {
+	var changes []string
+	oldValue := reflect.ValueOf(*old)
+	newValue := reflect.ValueOf(*new)
+	for i := 0; i < oldValue.NumField(); i++ {
+		name := oldValue.Type().Field(i).Name
+		oldField := oldValue.Field(i).Interface()
+		newField := newValue.Field(i).Interface()
+		if reflect.DeepEqual(oldField, newField) {
+			continue
+		}
+		switch name {
+		case "AuthToken", "PSK", "TrojanPassword", "SSPassword", "DecoyResponse":
+			changes = append(changes, fmt.Sprintf("%s changed", name))
+		default:
+			changes = append(changes, fmt.Sprintf("%s: %v -> %v", name, oldField, newField))
+		}
+	}
+	return changes
+}
+
+// KeepFields copies the named fields of current into config where they differ and returns the names copied
+func KeepFields(config, current *Config, names []string) []string {
+	var kept []string
+	configValue := reflect.ValueOf(config).Elem()
+	currentValue := reflect.ValueOf(current).Elem()
+	for _, name := range names {
+		field := configValue.FieldByName(name)
+		currentField := currentValue.FieldByName(name)
+		if reflect.DeepEqual(field.Interface(), currentField.Interface()) {
+			continue
+		}
+		field.Set(currentField)
+		kept = append(kept, name)
+	}
+	return kept
+}
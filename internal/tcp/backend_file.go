@@ -0,0 +1,97 @@
+package tcp
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// backendsFilePoll is how often a backends file is checked for changes
+const backendsFilePoll = 2 * time.Second
+
+// ReadBackendsFile reads one backend per line as host:port or host:port#weight,
+// blank lines and lines starting with # are skipped
+func ReadBackendsFile(path string) ([]BackendTarget, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var targets []BackendTarget
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		target, err := ParseBackendTarget(line)
+		if err != nil {
+			return nil, err
+		}
+		targets = append(targets, target)
+	}
+	return targets, scanner.Err()
+}
+
+// WatchFile fills the pool from the backends file at path and reloads it whenever the file changes,
+// a file that cannot be read keeps the previous backends
+func (bp *BackendPool) WatchFile(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	targets, err := ReadBackendsFile(path)
+	if err != nil {
+		return err
+	}
+	bp.Update(targets)
+
+	go func() {
+		modTime, size := info.ModTime(), info.Size()
+		lastErr := ""
+		for range time.Tick(backendsFilePoll) {
+			info, err := os.Stat(path)
+			if err == nil && info.ModTime().Equal(modTime) && info.Size() == size {
+				continue
+			}
+			if err == nil {
+				modTime, size = info.ModTime(), info.Size()
+				targets, err = ReadBackendsFile(path)
+			}
+			if err != nil {
+				// report a failure once until it changes
+				if err.Error() != lastErr {
+					fmt.Printf("Cannot reload backends file '%s'\n", err)
+					lastErr = err.Error()
+				}
+				continue
+			}
+			lastErr = ""
+			bp.Update(targets)
+			fmt.Printf("Backends reloaded from %s, %d backends\n", path, len(targets))
+		}
+	}()
+	return nil
+}
+
+// ParseBackendTarget parses host:port with an optional #weight suffix, the weight defaults to 1
+func ParseBackendTarget(s string) (BackendTarget, error) {
+	target := BackendTarget{Address: s, Weight: 1}
+	if i := strings.LastIndex(s, "#"); i >= 0 {
+		weight, err := strconv.Atoi(s[i+1:])
+		if err != nil || weight < 1 {
+			return target, fmt.Errorf("invalid backend weight '%s'", s)
+		}
+		target.Address = strings.TrimSpace(s[:i])
+		target.Weight = weight
+	}
+	if _, _, err := net.SplitHostPort(target.Address); err != nil {
+		return target, err
+	}
+	return target, nil
+}
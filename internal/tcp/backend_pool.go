@@ -0,0 +1,321 @@
+package tcp
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errNoBackend = errors.New("no backend available")
+
+// circuit breaker states of a backend
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half-open"
+)
+
+// BackendTarget is a backend address with its selection priority (lower is preferred) and relative weight
+type BackendTarget struct {
+	Address  string
+	Priority int
+	Weight   int
+}
+
+// BackendState is a backend with its circuit breaker state
+type BackendState struct {
+	Address  string `json:"address"`
+	Priority int    `json:"priority"`
+	Weight   int    `json:"weight"`
+	Breaker  string `json:"breaker"`
+	Failures int    `json:"failures"`
+}
+
+type backend struct {
+	BackendTarget
+	// smooth weighted round robin counter
+	current   int
+	failures  int
+	openUntil time.Time
+	// a half-open backend admits no other connection until the probe reports or this passes
+	probeUntil time.Time
+}
+
+// BackendPool picks backends for new connections from a set that discovery may replace at any time
+type BackendPool struct {
+	mu              sync.Mutex
+	backends        []*backend
+	breakerFailures int
+	breakerCooldown time.Duration
+	drainTimeout    time.Duration
+	// close funcs of the connections made to each backend address
+	conns  map[string]map[uint64]func()
+	connId uint64
+}
+
+func NewBackendPool() *BackendPool {
+	return &BackendPool{
+		conns: make(map[string]map[uint64]func()),
+	}
+}
+
+// SetDrainTimeout closes the connections of a backend removed from the pool after d,
+// zero lets them drain until they close on their own
+func (bp *BackendPool) SetDrainTimeout(d time.Duration) {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	bp.drainTimeout = d
+}
+
+// Track registers a connection made to address, closeFn is called when the backend is removed and the drain
+// timeout passes. The returned func must be called once the connection is closed.
+func (bp *BackendPool) Track(address string, closeFn func()) func() {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	bp.connId++
+	id := bp.connId
+	if bp.conns[address] == nil {
+		bp.conns[address] = make(map[uint64]func())
+	}
+	bp.conns[address][id] = closeFn
+	return func() {
+		bp.mu.Lock()
+		defer bp.mu.Unlock()
+		delete(bp.conns[address], id)
+		if len(bp.conns[address]) == 0 {
+			delete(bp.conns, address)
+		}
+	}
+}
+
+// SetBreaker takes a backend out of rotation for cooldown after failures consecutive dial failures,
+// then lets a single connection probe it. Zero failures disables the breaker.
+func (bp *BackendPool) SetBreaker(failures int, cooldown time.Duration) {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	bp.breakerFailures = failures
+	bp.breakerCooldown = cooldown
+}
+
+// Update replaces the backend set, connections already made to removed backends are not touched
+func (bp *BackendPool) Update(targets []BackendTarget) {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+
+	// backends that stay keep their breaker state
+	current := make(map[string]*backend, len(bp.backends))
+	for _, b := range bp.backends {
+		current[b.Address] = b
+	}
+	backends := make([]*backend, 0, len(targets))
+	for _, target := range targets {
+		b := current[target.Address]
+		if b == nil {
+			b = &backend{}
+		}
+		b.BackendTarget = target
+		backends = append(backends, b)
+		delete(current, target.Address)
+	}
+	bp.backends = backends
+
+	for address := range current {
+		if len(bp.conns[address]) == 0 {
+			continue
+		}
+		if bp.drainTimeout <= 0 {
+			fmt.Printf("Backend %s removed, draining %d connections\n", address, len(bp.conns[address]))
+			continue
+		}
+		fmt.Printf("Backend %s removed, closing %d connections in %s\n", address, len(bp.conns[address]), bp.drainTimeout)
+		address := address
+		time.AfterFunc(bp.drainTimeout, func() {
+			bp.closeRemoved(address)
+		})
+	}
+}
+
+// closeRemoved closes the connections left on address unless the backend was added back meanwhile
+func (bp *BackendPool) closeRemoved(address string) {
+	bp.mu.Lock()
+	for _, b := range bp.backends {
+		if b.Address == address {
+			bp.mu.Unlock()
+			return
+		}
+	}
+	closeFns := make([]func(), 0, len(bp.conns[address]))
+	for _, closeFn := range bp.conns[address] {
+		closeFns = append(closeFns, closeFn)
+	}
+	bp.mu.Unlock()
+
+	if len(closeFns) > 0 {
+		fmt.Printf("Backend %s drain timeout passed, closing %d connections\n", address, len(closeFns))
+	}
+	// closing runs without the lock, the untrack funcs take it
+	for _, closeFn := range closeFns {
+		closeFn()
+	}
+}
+
+// Pick returns an available backend address of the lowest priority, backends of that priority take turns in proportion
+// to their weights with smooth weighted round robin so a heavy backend does not get its picks in a burst
+func (bp *BackendPool) Pick() (string, error) {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+
+	now := time.Now()
+	var candidates []*backend
+	totalWeight := 0
+	for _, b := range bp.backends {
+		if !bp.available(b, now) {
+			continue
+		}
+		if len(candidates) > 0 && b.Priority > candidates[0].Priority {
+			continue
+		}
+		if len(candidates) > 0 && b.Priority < candidates[0].Priority {
+			candidates = candidates[:0]
+			totalWeight = 0
+		}
+		candidates = append(candidates, b)
+		totalWeight += b.Weight
+	}
+	if len(candidates) == 0 {
+		return "", errNoBackend
+	}
+
+	var picked *backend
+	for _, b := range candidates {
+		weight := b.Weight
+		// candidates without weights take equal turns
+		if totalWeight == 0 {
+			weight = 1
+		}
+		b.current += weight
+		if picked == nil || b.current > picked.current {
+			picked = b
+		}
+	}
+	if totalWeight == 0 {
+		totalWeight = len(candidates)
+	}
+	picked.current -= totalWeight
+	// the first pick after the cooldown is the half-open probe
+	if bp.breakerState(picked, now) == BreakerHalfOpen {
+		picked.probeUntil = now.Add(bp.breakerCooldown)
+	}
+	return picked.Address, nil
+}
+
+// Report records the dial result of a connection to address for its circuit breaker
+func (bp *BackendPool) Report(address string, err error) {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	for _, b := range bp.backends {
+		if b.Address != address {
+			continue
+		}
+		b.probeUntil = time.Time{}
+		if err == nil {
+			b.failures = 0
+			b.openUntil = time.Time{}
+			return
+		}
+		b.failures++
+		if bp.breakerFailures > 0 && b.failures >= bp.breakerFailures {
+			b.openUntil = time.Now().Add(bp.breakerCooldown)
+		}
+		return
+	}
+}
+
+// States lists the backends with their circuit breaker state
+func (bp *BackendPool) States() []BackendState {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	now := time.Now()
+	states := make([]BackendState, 0, len(bp.backends))
+	for _, b := range bp.backends {
+		states = append(states, BackendState{
+			Address:  b.Address,
+			Priority: b.Priority,
+			Weight:   b.Weight,
+			Breaker:  bp.breakerState(b, now),
+			Failures: b.failures,
+		})
+	}
+	return states
+}
+
+func (bp *BackendPool) breakerState(b *backend, now time.Time) string {
+	if bp.breakerFailures <= 0 || b.failures < bp.breakerFailures {
+		return BreakerClosed
+	}
+	if now.Before(b.openUntil) {
+		return BreakerOpen
+	}
+	return BreakerHalfOpen
+}
+
+func (bp *BackendPool) available(b *backend, now time.Time) bool {
+	switch bp.breakerState(b, now) {
+	case BreakerOpen:
+		return false
+	case BreakerHalfOpen:
+		return !now.Before(b.probeUntil)
+	}
+	return true
+}
+
+// IsSRVName reports whether address is a DNS SRV name like _tunnel._tcp.example.com rather than host:port
+func IsSRVName(address string) bool {
+	return strings.HasPrefix(address, "_") && !strings.Contains(address, ":")
+}
+
+// LookupSRV resolves an SRV name into backend targets
+func LookupSRV(name string) ([]BackendTarget, error) {
+	_, records, err := net.LookupSRV("", "", name)
+	if err != nil {
+		return nil, err
+	}
+	targets := make([]BackendTarget, 0, len(records))
+	for _, record := range records {
+		targets = append(targets, BackendTarget{
+			Address:  net.JoinHostPort(strings.TrimSuffix(record.Target, "."), strconv.Itoa(int(record.Port))),
+			Priority: int(record.Priority),
+			Weight:   int(record.Weight),
+		})
+	}
+	return targets, nil
+}
+
+// WatchSRV fills the pool from the SRV record name and looks it up again every interval,
+// a failed refresh keeps the previous backends
+func (bp *BackendPool) WatchSRV(name string, interval time.Duration) error {
+	targets, err := LookupSRV(name)
+	if err != nil {
+		return err
+	}
+	bp.Update(targets)
+	if interval <= 0 {
+		return nil
+	}
+
+	go func() {
+		for range time.Tick(interval) {
+			targets, err := LookupSRV(name)
+			if err != nil {
+				fmt.Printf("Cannot refresh SRV record %s '%s'\n", name, err)
+				continue
+			}
+			bp.Update(targets)
+		}
+	}()
+	return nil
+}
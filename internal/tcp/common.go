@@ -4,6 +4,13 @@ import (
 	"fmt"
 	"net"
 	"os"
+	"syscall"
+	"time"
+)
+
+const (
+	minAcceptDelay = 5 * time.Millisecond
+	maxAcceptDelay = time.Second
 )
 
 type Host struct {
@@ -20,14 +27,71 @@ func CloseConnection(conn net.Conn) {
 }
 
 func ResolveAddr(addr string) *net.TCPAddr {
+	return ResolveNetworkAddr("tcp", addr)
+}
+
+func ResolveNetworkAddr(network, addr string) *net.TCPAddr {
 	if addr == "" {
 		fmt.Printf("Host address is not valid or empty\n")
 		os.Exit(1)
 	}
-	tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+	tcpAddr, err := net.ResolveTCPAddr(network, addr)
 	if err != nil {
 		fmt.Printf("Failed to resolve local address: %s\n", err)
 		os.Exit(1)
 	}
 	return tcpAddr
 }
+
+// ValidateSourceAddr checks addr (ip or ip:port) is assignable on this host
+func ValidateSourceAddr(addr string) {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "0")
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		fmt.Printf("Invalid source address: %s\n", err)
+		os.Exit(1)
+	}
+	ln.Close()
+}
+
+// ChainControl runs every non-nil control func in order, nil when there is none
+func ChainControl(controls ...ControlFunc) ControlFunc {
+	var chain []ControlFunc
+	for _, control := range controls {
+		if control != nil {
+			chain = append(chain, control)
+		}
+	}
+	if len(chain) == 0 {
+		return nil
+	}
+	return func(network, address string, c syscall.RawConn) error {
+		for _, control := range chain {
+			err := control(network, address, c)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// IsTemporary reports whether an accept error clears on its own, e.g. too many open files
+func IsTemporary(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && (netErr.Temporary() || netErr.Timeout())
+}
+
+// NextAcceptDelay doubles the wait after a temporary accept error up to maxAcceptDelay
+func NextAcceptDelay(delay time.Duration) time.Duration {
+	if delay == 0 {
+		return minAcceptDelay
+	}
+	delay *= 2
+	if delay > maxAcceptDelay {
+		delay = maxAcceptDelay
+	}
+	return delay
+}
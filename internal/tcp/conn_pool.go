@@ -0,0 +1,95 @@
+package tcp
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// idle connections older than this are closed instead of handed out, backends and middleboxes drop idle
+// connections silently
+const connPoolIdleTTL = 30 * time.Second
+
+// ConnPool keeps pre-dialed tcp connections per target so new sessions skip the dial round trip
+type ConnPool struct {
+	mu          sync.Mutex
+	maxIdle     int
+	dialTimeout time.Duration
+	idle        map[string][]idleConn
+	filling     map[string]bool
+}
+
+type idleConn struct {
+	conn   net.Conn
+	dialed time.Time
+}
+
+func NewConnPool(maxIdle int, dialTimeout time.Duration) *ConnPool {
+	return &ConnPool{
+		maxIdle:     maxIdle,
+		dialTimeout: dialTimeout,
+		idle:        make(map[string][]idleConn),
+		filling:     make(map[string]bool),
+	}
+}
+
+// Get returns a healthy idle connection to target or dials a new one, the pool is refilled in the background
+func (cp *ConnPool) Get(target string) (net.Conn, error) {
+	defer cp.refill(target)
+	for {
+		ic, ok := cp.pop(target)
+		if !ok {
+			break
+		}
+		if time.Since(ic.dialed) < connPoolIdleTTL && !connClosed(ic.conn) {
+			return ic.conn, nil
+		}
+		ic.conn.Close()
+	}
+	return net.DialTimeout("tcp", target, cp.dialTimeout)
+}
+
+func (cp *ConnPool) pop(target string) (idleConn, bool) {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	conns := cp.idle[target]
+	if len(conns) == 0 {
+		return idleConn{}, false
+	}
+	ic := conns[len(conns)-1]
+	cp.idle[target] = conns[:len(conns)-1]
+	return ic, true
+}
+
+func (cp *ConnPool) refill(target string) {
+	cp.mu.Lock()
+	if cp.filling[target] {
+		cp.mu.Unlock()
+		return
+	}
+	cp.filling[target] = true
+	cp.mu.Unlock()
+
+	go func() {
+		defer func() {
+			cp.mu.Lock()
+			cp.filling[target] = false
+			cp.mu.Unlock()
+		}()
+		for {
+			cp.mu.Lock()
+			full := len(cp.idle[target]) >= cp.maxIdle
+			cp.mu.Unlock()
+			if full {
+				return
+			}
+			conn, err := net.DialTimeout("tcp", target, cp.dialTimeout)
+			if err != nil {
+				return
+			}
+			cp.mu.Lock()
+			cp.idle[target] = append(cp.idle[target], idleConn{conn: conn, dialed: time.Now()})
+			cp.mu.Unlock()
+		}
+	}()
+}
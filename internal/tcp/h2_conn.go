@@ -0,0 +1,281 @@
+package tcp
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+	"io"
+	"net"
+	"sync"
+)
+
+const (
+	h2StreamId     = 1
+	h2RecvWindow   = 1 << 20
+	h2DefaultFrame = 16384
+	// SETTINGS_ENABLE_CONNECT_PROTOCOL of RFC 8441, missing in x/net
+	h2SettingEnableConnectProtocol http2.SettingID = 0x8
+)
+
+// H2Conn carries a byte stream over a single HTTP/2 CONNECT stream
+type H2Conn struct {
+	net.Conn
+	framer       *http2.Framer
+	wMu          sync.Mutex
+	mu           sync.Mutex
+	cond         *sync.Cond
+	recvBuf      bytes.Buffer
+	readErr      error
+	connWindow   int64
+	streamWindow int64
+	maxFrameSize uint32
+	// SETTINGS_INITIAL_WINDOW_SIZE last applied to streamWindow
+	initialWindow   uint32
+	connectProtocol bool
+	settingsSeen    bool
+}
+
+// H2Connect opens a CONNECT stream to authority, protocol and path are set for extended CONNECT (RFC 8441)
+func H2Connect(conn net.Conn, authority, protocol, path string) (*H2Conn, error) {
+	c := &H2Conn{
+		Conn:          conn,
+		framer:        http2.NewFramer(conn, conn),
+		connWindow:    65535,
+		streamWindow:  65535,
+		maxFrameSize:  h2DefaultFrame,
+		initialWindow: 65535,
+	}
+	c.cond = sync.NewCond(&c.mu)
+	c.framer.ReadMetaHeaders = hpack.NewDecoder(4096, nil)
+
+	_, err := io.WriteString(conn, http2.ClientPreface)
+	if err != nil {
+		return nil, err
+	}
+	err = c.framer.WriteSettings(http2.Setting{ID: http2.SettingInitialWindowSize, Val: h2RecvWindow})
+	if err != nil {
+		return nil, err
+	}
+	err = c.framer.WriteWindowUpdate(0, h2RecvWindow-65535)
+	if err != nil {
+		return nil, err
+	}
+
+	// extended CONNECT may only be sent once the server preface enabled it
+	if protocol != "" {
+		for !c.settingsSeen {
+			f, err := c.framer.ReadFrame()
+			if err != nil {
+				return nil, err
+			}
+			err = c.handleFrame(f)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if !c.connectProtocol {
+			return nil, errors.New("http2 server does not support extended CONNECT (SETTINGS_ENABLE_CONNECT_PROTOCOL)")
+		}
+	}
+
+	var hBuf bytes.Buffer
+	enc := hpack.NewEncoder(&hBuf)
+	enc.WriteField(hpack.HeaderField{Name: ":method", Value: "CONNECT"})
+	enc.WriteField(hpack.HeaderField{Name: ":authority", Value: authority})
+	if protocol != "" {
+		enc.WriteField(hpack.HeaderField{Name: ":protocol", Value: protocol})
+		enc.WriteField(hpack.HeaderField{Name: ":scheme", Value: "https"})
+		enc.WriteField(hpack.HeaderField{Name: ":path", Value: path})
+	}
+	if protocol == "websocket" {
+		enc.WriteField(hpack.HeaderField{Name: "sec-websocket-version", Value: "13"})
+	}
+	err = c.framer.WriteHeaders(http2.HeadersFrameParam{
+		StreamID:      h2StreamId,
+		BlockFragment: hBuf.Bytes(),
+		EndHeaders:    true,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		f, err := c.framer.ReadFrame()
+		if err != nil {
+			return nil, err
+		}
+		if hf, ok := f.(*http2.MetaHeadersFrame); ok && hf.StreamID == h2StreamId {
+			status := hf.PseudoValue("status")
+			if status != "200" {
+				return nil, fmt.Errorf("unexpected CONNECT response status '%s'", status)
+			}
+			break
+		}
+		err = c.handleFrame(f)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	go c.readLoop()
+	return c, nil
+}
+
+func (c *H2Conn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	for c.recvBuf.Len() == 0 && c.readErr == nil {
+		c.cond.Wait()
+	}
+	if c.recvBuf.Len() == 0 {
+		err := c.readErr
+		c.mu.Unlock()
+		return 0, err
+	}
+	n, _ := c.recvBuf.Read(b)
+	c.mu.Unlock()
+
+	// give the consumed bytes back to the peer
+	c.giveWindow(uint32(n))
+	return n, nil
+}
+
+// giveWindow sends n bytes of flow control window back to the peer, a zero increment is a protocol error
+func (c *H2Conn) giveWindow(n uint32) {
+	if n == 0 {
+		return
+	}
+	c.wMu.Lock()
+	defer c.wMu.Unlock()
+	c.framer.WriteWindowUpdate(0, n)
+	c.framer.WriteWindowUpdate(h2StreamId, n)
+}
+
+func (c *H2Conn) Write(b []byte) (int, error) {
+	written := 0
+	for written < len(b) {
+		c.mu.Lock()
+		for (c.connWindow <= 0 || c.streamWindow <= 0) && c.readErr == nil {
+			c.cond.Wait()
+		}
+		if c.readErr != nil {
+			err := c.readErr
+			c.mu.Unlock()
+			return written, err
+		}
+		n := int64(len(b) - written)
+		if n > c.connWindow {
+			n = c.connWindow
+		}
+		if n > c.streamWindow {
+			n = c.streamWindow
+		}
+		if n > int64(c.maxFrameSize) {
+			n = int64(c.maxFrameSize)
+		}
+		c.connWindow -= n
+		c.streamWindow -= n
+		c.mu.Unlock()
+
+		c.wMu.Lock()
+		err := c.framer.WriteData(h2StreamId, false, b[written:written+int(n)])
+		c.wMu.Unlock()
+		if err != nil {
+			return written, err
+		}
+		written += int(n)
+	}
+	return written, nil
+}
+
+func (c *H2Conn) Close() error {
+	c.wMu.Lock()
+	c.framer.WriteRSTStream(h2StreamId, http2.ErrCodeCancel)
+	c.wMu.Unlock()
+	return c.Conn.Close()
+}
+
+func (c *H2Conn) readLoop() {
+	for {
+		f, err := c.framer.ReadFrame()
+		if err == nil {
+			err = c.handleFrame(f)
+		}
+		if err != nil {
+			c.mu.Lock()
+			c.readErr = err
+			c.cond.Broadcast()
+			c.mu.Unlock()
+			return
+		}
+	}
+}
+
+func (c *H2Conn) handleFrame(f http2.Frame) error {
+	switch f := f.(type) {
+	case *http2.DataFrame:
+		if f.StreamID != h2StreamId {
+			return nil
+		}
+		c.mu.Lock()
+		c.recvBuf.Write(f.Data())
+		c.cond.Broadcast()
+		c.mu.Unlock()
+		// padding counts against the window but never reaches Read
+		c.giveWindow(f.Length - uint32(len(f.Data())))
+		if f.StreamEnded() {
+			return io.EOF
+		}
+	case *http2.SettingsFrame:
+		if f.IsAck() {
+			return nil
+		}
+		c.mu.Lock()
+		f.ForeachSetting(func(s http2.Setting) error {
+			switch s.ID {
+			case http2.SettingInitialWindowSize:
+				c.streamWindow += int64(s.Val) - int64(c.initialWindow)
+				c.initialWindow = s.Val
+			case http2.SettingMaxFrameSize:
+				c.maxFrameSize = s.Val
+			case h2SettingEnableConnectProtocol:
+				c.connectProtocol = s.Val == 1
+			}
+			return nil
+		})
+		c.settingsSeen = true
+		c.cond.Broadcast()
+		c.mu.Unlock()
+		c.wMu.Lock()
+		defer c.wMu.Unlock()
+		return c.framer.WriteSettingsAck()
+	case *http2.WindowUpdateFrame:
+		c.mu.Lock()
+		if f.StreamID == 0 {
+			c.connWindow += int64(f.Increment)
+		} else if f.StreamID == h2StreamId {
+			c.streamWindow += int64(f.Increment)
+		}
+		c.cond.Broadcast()
+		c.mu.Unlock()
+	case *http2.PingFrame:
+		if f.IsAck() {
+			return nil
+		}
+		c.wMu.Lock()
+		defer c.wMu.Unlock()
+		return c.framer.WritePing(true, f.Data)
+	case *http2.RSTStreamFrame:
+		if f.StreamID == h2StreamId {
+			return io.EOF
+		}
+	case *http2.GoAwayFrame:
+		return errors.New("http2 connection closed by peer (GOAWAY)")
+	case *http2.MetaHeadersFrame:
+		if f.StreamID == h2StreamId && f.StreamEnded() {
+			return io.EOF
+		}
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package tcp
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// buckets of clients without active connections are dropped after this period
+const ipLimiterIdleExpiry = time.Minute
+
+// IPLimiter limits new connections per client ip with a token bucket and caps concurrent connections per ip
+type IPLimiter struct {
+	mu       sync.Mutex
+	rate     float64
+	burst    float64
+	maxPerIP int
+	clients  map[string]*ipBucket
+}
+
+type ipBucket struct {
+	tokens float64
+	last   time.Time
+	active int
+}
+
+// NewIPLimiter allows rate new connections per second (zero disables) and maxPerIP concurrent connections
+// (zero disables) for each client ip
+func NewIPLimiter(rate float64, maxPerIP int) *IPLimiter {
+	burst := rate
+	if burst < 1 {
+		burst = 1
+	}
+	l := &IPLimiter{
+		rate:     rate,
+		burst:    burst,
+		maxPerIP: maxPerIP,
+		clients:  make(map[string]*ipBucket),
+	}
+	go l.expire()
+	return l
+}
+
+// Acquire reports whether a new connection from addr is allowed, allowed connections must be released
+func (l *IPLimiter) Acquire(addr net.Addr) bool {
+	ip := limiterKey(addr)
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b, ok := l.clients[ip]
+	if !ok {
+		b = &ipBucket{tokens: l.burst, last: now}
+		l.clients[ip] = b
+	}
+	if l.rate > 0 {
+		b.tokens += now.Sub(b.last).Seconds() * l.rate
+		if b.tokens > l.burst {
+			b.tokens = l.burst
+		}
+	}
+	b.last = now
+	if l.maxPerIP > 0 && b.active >= l.maxPerIP {
+		return false
+	}
+	if l.rate > 0 {
+		if b.tokens < 1 {
+			return false
+		}
+		b.tokens--
+	}
+	b.active++
+	return true
+}
+
+func (l *IPLimiter) Release(addr net.Addr) {
+	ip := limiterKey(addr)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if b, ok := l.clients[ip]; ok && b.active > 0 {
+		b.active--
+		b.last = time.Now()
+	}
+}
+
+func (l *IPLimiter) expire() {
+	for {
+		time.Sleep(ipLimiterIdleExpiry)
+		l.mu.Lock()
+		for ip, b := range l.clients {
+			if b.active == 0 && time.Since(b.last) > ipLimiterIdleExpiry {
+				delete(l.clients, ip)
+			}
+		}
+		l.mu.Unlock()
+	}
+}
+
+func limiterKey(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
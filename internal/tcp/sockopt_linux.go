@@ -0,0 +1,161 @@
+package tcp
+
+import (
+	"errors"
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	// soOriginalDst is SO_ORIGINAL_DST from linux/netfilter_ipv4.h, IP6T_SO_ORIGINAL_DST has the same value
+	soOriginalDst = 80
+	// ipv6Transparent is IPV6_TRANSPARENT from linux/in6.h, missing from syscall
+	ipv6Transparent = 75
+	// soReusePort is SO_REUSEPORT from asm-generic/socket.h, missing from syscall
+	soReusePort = 15
+)
+
+type ControlFunc func(network, address string, c syscall.RawConn) error
+
+func ControlFwMark(mark int) ControlFunc {
+	return func(network, address string, c syscall.RawConn) error {
+		var sockErr error
+		err := c.Control(func(fd uintptr) {
+			sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_MARK, mark)
+		})
+		if err != nil {
+			return err
+		}
+		return sockErr
+	}
+}
+
+// ControlTransparent sets IP_TRANSPARENT so a listener accepts TPROXY connections and a dialer can bind a foreign address,
+// it needs CAP_NET_ADMIN
+func ControlTransparent() ControlFunc {
+	return func(network, address string, c syscall.RawConn) error {
+		var sockErr error
+		err := c.Control(func(fd uintptr) {
+			if network == "tcp6" {
+				sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_IPV6, ipv6Transparent, 1)
+				return
+			}
+			sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_TRANSPARENT, 1)
+		})
+		if err != nil {
+			return err
+		}
+		return sockErr
+	}
+}
+
+// ControlReusePort sets SO_REUSEPORT so several processes can listen on the same address, the kernel spreads
+// new connections across them
+func ControlReusePort() ControlFunc {
+	return func(network, address string, c syscall.RawConn) error {
+		var sockErr error
+		err := c.Control(func(fd uintptr) {
+			sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+		})
+		if err != nil {
+			return err
+		}
+		return sockErr
+	}
+}
+
+// OriginalDst returns the destination a connection had before iptables REDIRECT or DNAT rewrote it
+func OriginalDst(conn net.Conn) (*net.TCPAddr, error) {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return nil, errors.New("connection does not expose its socket")
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	var addr *net.TCPAddr
+	var sockErr error
+	local, _ := conn.LocalAddr().(*net.TCPAddr)
+	err = rc.Control(func(fd uintptr) {
+		if local != nil && local.IP.To4() == nil {
+			// the option fills a sockaddr_in6, IPv6MTUInfo starts with one
+			info, err := syscall.GetsockoptIPv6MTUInfo(int(fd), syscall.IPPROTO_IPV6, soOriginalDst)
+			if err != nil {
+				sockErr = err
+				return
+			}
+			port := (*[2]byte)(unsafe.Pointer(&info.Addr.Port))
+			ip := make(net.IP, net.IPv6len)
+			copy(ip, info.Addr.Addr[:])
+			addr = &net.TCPAddr{IP: ip, Port: int(port[0])<<8 | int(port[1])}
+			return
+		}
+		// the option fills a sockaddr_in, IPv6Mreq is large enough to hold one
+		mreq, err := syscall.GetsockoptIPv6Mreq(int(fd), syscall.IPPROTO_IP, soOriginalDst)
+		if err != nil {
+			sockErr = err
+			return
+		}
+		raw := mreq.Multiaddr
+		addr = &net.TCPAddr{IP: net.IPv4(raw[4], raw[5], raw[6], raw[7]), Port: int(raw[2])<<8 | int(raw[3])}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if sockErr != nil {
+		return nil, sockErr
+	}
+	if local != nil && addr.IP.Equal(local.IP) && addr.Port == local.Port {
+		return nil, errors.New("connection was not redirected")
+	}
+	return addr, nil
+}
+
+// SetListenBacklog calls listen again on the socket of ln, linux then resizes the accept queue to n,
+// capped by net.core.somaxconn. It cannot go in a ListenConfig Control func which runs before bind.
+func SetListenBacklog(ln net.Listener, n int) error {
+	sc, ok := ln.(syscall.Conn)
+	if !ok {
+		return errors.New("listener does not expose its socket")
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var sockErr error
+	err = rc.Control(func(fd uintptr) {
+		sockErr = syscall.Listen(int(fd), n)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// connClosed peeks at the socket of an idle connection without blocking or consuming data, only EOF or a socket
+// error mean the peer is gone. Data the backend sent first stays queued for the session.
+func connClosed(conn net.Conn) bool {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return false
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return false
+	}
+	var n int
+	var peekErr error
+	err = rc.Control(func(fd uintptr) {
+		n, _, peekErr = syscall.Recvfrom(int(fd), make([]byte, 1), syscall.MSG_PEEK|syscall.MSG_DONTWAIT)
+	})
+	if err != nil {
+		return true
+	}
+	if peekErr == syscall.EAGAIN || peekErr == syscall.EINTR {
+		return false
+	}
+	return peekErr != nil || n == 0
+}
@@ -0,0 +1,48 @@
+//go:build !linux
+// +build !linux
+
+package tcp
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+type ControlFunc func(network, address string, c syscall.RawConn) error
+
+// ControlFwMark is a no-op, SO_MARK is linux only
+func ControlFwMark(mark int) ControlFunc {
+	return func(network, address string, c syscall.RawConn) error {
+		return nil
+	}
+}
+
+// ControlTransparent always fails, IP_TRANSPARENT is linux only
+func ControlTransparent() ControlFunc {
+	return func(network, address string, c syscall.RawConn) error {
+		return errors.New("tproxy is linux only")
+	}
+}
+
+// ControlReusePort always fails, SO_REUSEPORT load balancing is linux only
+func ControlReusePort() ControlFunc {
+	return func(network, address string, c syscall.RawConn) error {
+		return errors.New("reuseport is linux only")
+	}
+}
+
+// OriginalDst always fails, SO_ORIGINAL_DST is linux only
+func OriginalDst(conn net.Conn) (*net.TCPAddr, error) {
+	return nil, errors.New("transparent mode is linux only")
+}
+
+// SetListenBacklog always fails, resizing the accept queue of a listening socket is only supported on linux
+func SetListenBacklog(ln net.Listener, n int) error {
+	return errors.New("listen backlog is linux only")
+}
+
+// connClosed always reports false, idle connections are only checked without consuming data on linux
+func connClosed(conn net.Conn) bool {
+	return false
+}
@@ -0,0 +1,212 @@
+package tcp
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+	"io"
+	"net"
+	"sync"
+)
+
+// Shadowsocks AEAD stream (SIP004), each direction starts with a random salt followed by chunks:
+//
+//	[encrypted payload length][length tag][encrypted payload][payload tag]
+//
+// The length is 2 bytes big endian capped at 0x3fff. Each direction seals with a subkey derived from the key and
+// its salt by HKDF-SHA1 and a little endian counter nonce incremented after every seal or open.
+const (
+	SSCipherChacha20 = "chacha20-ietf-poly1305"
+
+	ssMaxPayload = 0x3fff
+	ssSubkeyInfo = "ss-subkey"
+)
+
+var (
+	errSSChunkSize = errors.New("invalid shadowsocks chunk size")
+	errSSReplay    = errors.New("shadowsocks salt seen before, possible replay")
+)
+
+// SSConn encrypts and decrypts a byte stream with the Shadowsocks AEAD framing over conn
+type SSConn struct {
+	net.Conn
+	key    []byte
+	reader cipher.AEAD
+	writer cipher.AEAD
+	rNonce []byte
+	wNonce []byte
+	rBuff  []byte
+	rData  []byte
+	salts  *SSSaltCache
+}
+
+func NewSSConn(conn net.Conn, key []byte) (*SSConn, error) {
+	if len(key) != chacha20poly1305.KeySize {
+		return nil, errors.New("shadowsocks key must be 32 bytes")
+	}
+	return &SSConn{
+		Conn: conn,
+		key:  key,
+	}, nil
+}
+
+// SetSaltCache refuses streams whose salt is in cache and adds the salts of both directions to it
+func (c *SSConn) SetSaltCache(cache *SSSaltCache) {
+	c.salts = cache
+}
+
+func (c *SSConn) aead(salt []byte) (cipher.AEAD, error) {
+	subkey := make([]byte, chacha20poly1305.KeySize)
+	_, err := io.ReadFull(hkdf.New(sha1.New, c.key, salt, []byte(ssSubkeyInfo)), subkey)
+	if err != nil {
+		return nil, err
+	}
+	return chacha20poly1305.New(subkey)
+}
+
+func (c *SSConn) Write(b []byte) (int, error) {
+	if c.writer == nil {
+		salt := make([]byte, chacha20poly1305.KeySize)
+		_, err := rand.Read(salt)
+		if err != nil {
+			return 0, err
+		}
+		if c.salts != nil {
+			c.salts.Add(salt)
+		}
+		c.writer, err = c.aead(salt)
+		if err != nil {
+			return 0, err
+		}
+		c.wNonce = make([]byte, c.writer.NonceSize())
+		_, err = c.Conn.Write(salt)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	written := 0
+	for written < len(b) {
+		n := len(b) - written
+		if n > ssMaxPayload {
+			n = ssMaxPayload
+		}
+		chunk := make([]byte, 0, 2+c.writer.Overhead()+n+c.writer.Overhead())
+		size := make([]byte, 2)
+		binary.BigEndian.PutUint16(size, uint16(n))
+		chunk = c.writer.Seal(chunk, c.wNonce, size, nil)
+		ssIncrementNonce(c.wNonce)
+		chunk = c.writer.Seal(chunk, c.wNonce, b[written:written+n], nil)
+		ssIncrementNonce(c.wNonce)
+		_, err := c.Conn.Write(chunk)
+		if err != nil {
+			return written, err
+		}
+		written += n
+	}
+	return written, nil
+}
+
+func (c *SSConn) Read(b []byte) (int, error) {
+	if len(c.rData) == 0 {
+		err := c.readChunk()
+		if err != nil {
+			return 0, err
+		}
+	}
+	n := copy(b, c.rData)
+	c.rData = c.rData[n:]
+	return n, nil
+}
+
+func (c *SSConn) readChunk() error {
+	if c.reader == nil {
+		salt := make([]byte, chacha20poly1305.KeySize)
+		_, err := io.ReadFull(c.Conn, salt)
+		if err != nil {
+			return err
+		}
+		if c.salts != nil && !c.salts.Add(salt) {
+			return errSSReplay
+		}
+		c.reader, err = c.aead(salt)
+		if err != nil {
+			return err
+		}
+		c.rNonce = make([]byte, c.reader.NonceSize())
+		c.rBuff = make([]byte, ssMaxPayload+c.reader.Overhead())
+	}
+
+	sealedSize := c.rBuff[:2+c.reader.Overhead()]
+	_, err := io.ReadFull(c.Conn, sealedSize)
+	if err != nil {
+		return err
+	}
+	size, err := c.reader.Open(sealedSize[:0], c.rNonce, sealedSize, nil)
+	if err != nil {
+		return err
+	}
+	ssIncrementNonce(c.rNonce)
+	n := int(binary.BigEndian.Uint16(size))
+	if n == 0 || n > ssMaxPayload {
+		return errSSChunkSize
+	}
+
+	sealedPayload := c.rBuff[:n+c.reader.Overhead()]
+	_, err = io.ReadFull(c.Conn, sealedPayload)
+	if err != nil {
+		return err
+	}
+	c.rData, err = c.reader.Open(sealedPayload[:0], c.rNonce, sealedPayload, nil)
+	if err != nil {
+		return err
+	}
+	ssIncrementNonce(c.rNonce)
+	return nil
+}
+
+func ssIncrementNonce(nonce []byte) {
+	for i := range nonce {
+		nonce[i]++
+		if nonce[i] != 0 {
+			return
+		}
+	}
+}
+
+// SSSaltCache remembers the most recent salts so a recorded stream replayed to the server is refused, the oldest
+// salt is forgotten once size salts are kept
+type SSSaltCache struct {
+	mu    sync.Mutex
+	seen  map[string]struct{}
+	order []string
+	next  int
+}
+
+func NewSSSaltCache(size int) *SSSaltCache {
+	return &SSSaltCache{
+		seen:  make(map[string]struct{}),
+		order: make([]string, size),
+	}
+}
+
+// Add records salt and reports whether it was new
+func (c *SSSaltCache) Add(salt []byte) bool {
+	key := string(salt)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.seen[key]; ok {
+		return false
+	}
+	if old := c.order[c.next]; old != "" {
+		delete(c.seen, old)
+	}
+	c.order[c.next] = key
+	c.next = (c.next + 1) % len(c.order)
+	c.seen[key] = struct{}{}
+	return true
+}
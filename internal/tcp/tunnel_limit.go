@@ -0,0 +1,31 @@
+package tcp
+
+import "sync/atomic"
+
+// TunnelLimit counts active websocket tunnels and caps them at max, zero max only counts
+type TunnelLimit struct {
+	active int64
+	max    int64
+}
+
+func NewTunnelLimit(max int) *TunnelLimit {
+	return &TunnelLimit{
+		max: int64(max),
+	}
+}
+
+func (t *TunnelLimit) Acquire() bool {
+	if atomic.AddInt64(&t.active, 1) > t.max && t.max > 0 {
+		atomic.AddInt64(&t.active, -1)
+		return false
+	}
+	return true
+}
+
+func (t *TunnelLimit) Release() {
+	atomic.AddInt64(&t.active, -1)
+}
+
+func (t *TunnelLimit) Active() int64 {
+	return atomic.LoadInt64(&t.active)
+}
@@ -0,0 +1,283 @@
+package tcp
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+)
+
+// DefaultUDPSessionIdle ends a UDP session that received no datagram for this long
+const DefaultUDPSessionIdle = 2 * time.Minute
+
+// maxDatagramSize is the largest UDP payload, it also bounds the 2 byte frame length
+const maxDatagramSize = 0xffff
+
+var errDatagramSize = errors.New("datagram larger than 65535 bytes")
+
+// UDPFrameConn carries datagrams over a stream conn, each one prefixed by its 2 byte big endian length.
+// Every Read returns one datagram, truncated to the buffer like a UDP socket does, and every Write sends one.
+type UDPFrameConn struct {
+	net.Conn
+	header []byte
+}
+
+func NewUDPFrameConn(conn net.Conn) *UDPFrameConn {
+	return &UDPFrameConn{
+		Conn:   conn,
+		header: make([]byte, 2),
+	}
+}
+
+func (c *UDPFrameConn) Read(b []byte) (int, error) {
+	_, err := io.ReadFull(c.Conn, c.header)
+	if err != nil {
+		return 0, err
+	}
+	n := int(binary.BigEndian.Uint16(c.header))
+	if n > len(b) {
+		// like a UDP socket the datagram is truncated, the rest is skipped to stay on the frame boundary
+		read, err := io.ReadFull(c.Conn, b)
+		if err != nil {
+			return read, err
+		}
+		_, err = io.CopyN(ioutil.Discard, c.Conn, int64(n-len(b)))
+		return read, err
+	}
+	return io.ReadFull(c.Conn, b[:n])
+}
+
+func (c *UDPFrameConn) Write(b []byte) (int, error) {
+	if len(b) > maxDatagramSize {
+		return 0, errDatagramSize
+	}
+	frame := make([]byte, 2+len(b))
+	binary.BigEndian.PutUint16(frame, uint16(len(b)))
+	copy(frame[2:], b)
+	_, err := c.Conn.Write(frame)
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// UDPListener turns the datagrams read from pc into connections, Accept returns a session for every new source
+// address and the later datagrams of that address are read from it. A session ends when it is closed or idle.
+type UDPListener struct {
+	pc        net.PacketConn
+	idle      time.Duration
+	mu        sync.Mutex
+	sessions  map[string]*udpSession
+	accept    chan *udpSession
+	closeOnce sync.Once
+	done      chan struct{}
+	closed    chan struct{}
+	err       error
+}
+
+func NewUDPListener(pc net.PacketConn, idle time.Duration) *UDPListener {
+	if idle <= 0 {
+		idle = DefaultUDPSessionIdle
+	}
+	l := &UDPListener{
+		pc:       pc,
+		idle:     idle,
+		sessions: make(map[string]*udpSession),
+		accept:   make(chan *udpSession),
+		done:     make(chan struct{}),
+		closed:   make(chan struct{}),
+	}
+	go l.readLoop()
+	return l
+}
+
+func (l *UDPListener) Accept() (net.Conn, error) {
+	select {
+	case s := <-l.accept:
+		return s, nil
+	case <-l.closed:
+		return nil, l.err
+	}
+}
+
+func (l *UDPListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.done)
+	})
+	return l.pc.Close()
+}
+
+func (l *UDPListener) Addr() net.Addr {
+	return l.pc.LocalAddr()
+}
+
+func (l *UDPListener) readLoop() {
+	buffer := make([]byte, maxDatagramSize)
+	for {
+		n, addr, err := l.pc.ReadFrom(buffer)
+		if err != nil {
+			l.err = err
+			close(l.closed)
+			return
+		}
+		datagram := make([]byte, n)
+		copy(datagram, buffer[:n])
+
+		l.mu.Lock()
+		s, ok := l.sessions[addr.String()]
+		if !ok {
+			s = newUDPSession(l, addr)
+			l.sessions[addr.String()] = s
+		}
+		l.mu.Unlock()
+		if !ok {
+			select {
+			case l.accept <- s:
+			case <-l.done:
+				// the next read fails on the closed packet conn
+				continue
+			}
+		}
+		// like the network, datagrams are dropped when the session does not keep up
+		select {
+		case s.datagrams <- datagram:
+		default:
+		}
+	}
+}
+
+func (l *UDPListener) remove(s *udpSession) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.sessions[s.addr.String()] == s {
+		delete(l.sessions, s.addr.String())
+	}
+}
+
+type udpTimeoutError struct{}
+
+func (udpTimeoutError) Error() string   { return "i/o timeout" }
+func (udpTimeoutError) Timeout() bool   { return true }
+func (udpTimeoutError) Temporary() bool { return true }
+
+// udpSession is the connection of one source address of a UDPListener
+type udpSession struct {
+	l         *UDPListener
+	addr      net.Addr
+	datagrams chan []byte
+	closeOnce sync.Once
+	closed    chan struct{}
+	mu        sync.Mutex
+	timer     *time.Timer
+	expired   chan struct{}
+	// idle is reused by every Read, reads come from a single goroutine
+	idle *time.Timer
+}
+
+func newUDPSession(l *UDPListener, addr net.Addr) *udpSession {
+	return &udpSession{
+		l:         l,
+		addr:      addr,
+		datagrams: make(chan []byte, 64),
+		closed:    make(chan struct{}),
+		expired:   make(chan struct{}),
+	}
+}
+
+// Read returns the next datagram truncated to b, io.EOF once the session is closed or received nothing within the
+// idle timeout
+func (s *udpSession) Read(b []byte) (int, error) {
+	if s.idle == nil {
+		s.idle = time.NewTimer(s.l.idle)
+	} else {
+		s.idle.Reset(s.l.idle)
+	}
+	s.mu.Lock()
+	expired := s.expired
+	s.mu.Unlock()
+
+	select {
+	case datagram := <-s.datagrams:
+		stopTimer(s.idle)
+		return copy(b, datagram), nil
+	case <-s.closed:
+		stopTimer(s.idle)
+		return 0, io.EOF
+	case <-s.idle.C:
+		return 0, io.EOF
+	case <-expired:
+		stopTimer(s.idle)
+		return 0, udpTimeoutError{}
+	}
+}
+
+// stopTimer stops t and drains a fire that raced the stop, so Reset starts from an empty chan
+func stopTimer(t *time.Timer) {
+	if !t.Stop() {
+		select {
+		case <-t.C:
+		default:
+		}
+	}
+}
+
+func (s *udpSession) Write(b []byte) (int, error) {
+	return s.l.pc.WriteTo(b, s.addr)
+}
+
+func (s *udpSession) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.closed)
+		s.l.remove(s)
+	})
+	return nil
+}
+
+func (s *udpSession) LocalAddr() net.Addr {
+	return s.l.pc.LocalAddr()
+}
+
+func (s *udpSession) RemoteAddr() net.Addr {
+	return s.addr
+}
+
+func (s *udpSession) SetDeadline(t time.Time) error {
+	return s.SetReadDeadline(t)
+}
+
+// SetReadDeadline closes the expired chan at t, a blocked Read sees a deadline moved to the past
+func (s *udpSession) SetReadDeadline(t time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.timer != nil && !s.timer.Stop() {
+		// the previous deadline passed, reads need a fresh chan
+		s.expired = make(chan struct{})
+	}
+	s.timer = nil
+	select {
+	case <-s.expired:
+		s.expired = make(chan struct{})
+	default:
+	}
+	if t.IsZero() {
+		return nil
+	}
+	expired := s.expired
+	wait := time.Until(t)
+	if wait <= 0 {
+		close(expired)
+		return nil
+	}
+	s.timer = time.AfterFunc(wait, func() {
+		close(expired)
+	})
+	return nil
+}
+
+// SetWriteDeadline is a no-op, writes to the shared packet conn do not block
+func (s *udpSession) SetWriteDeadline(t time.Time) error {
+	return nil
+}
@@ -2,17 +2,27 @@ package tcp
 
 import (
 	"bufio"
+	"bytes"
+	"crypto/rand"
 	"crypto/tls"
+	"encoding/hex"
 	"fmt"
+	"io"
 	"net"
 	"strings"
+	"time"
 )
 
+// request and backend response heads that do not arrive within this period are dropped, requests are read before
+// the client limits apply
+const headReadTimeout = 10 * time.Second
+
 type WebForwarder struct {
 	secure         bool
 	sni            string
 	connInfoPrefix string
 	connectionId   uint64
+	requestId      string
 	bufferSize     uint64
 	errCh          chan bool
 	srcConn        net.Conn
@@ -20,16 +30,27 @@ type WebForwarder struct {
 	dstAddress     string
 	trjAddress     string
 	trjWsPath      string
+	backendH2      bool
+	allowedOrigins []string
+	limiter        *IPLimiter
+	allowedDsts    []string
+	proxyProto     bool
+	dialTimeout    time.Duration
+	pool           *ConnPool
+	deflate        bool
+	tunnels        *TunnelLimit
 	erred          bool
 }
 
 func NewWebForwarder(connId uint64, src net.Conn, secure bool) *WebForwarder {
-	connInfoPrefix := fmt.Sprintf("CONN #%d", connId)
+	requestId := newRequestId()
+	connInfoPrefix := fmt.Sprintf("CONN #%d [%s]", connId, requestId)
 	if secure {
-		connInfoPrefix = fmt.Sprintf("CONN (TLS) #%d", connId)
+		connInfoPrefix = fmt.Sprintf("CONN (TLS) #%d [%s]", connId, requestId)
 	}
 	return &WebForwarder{
 		connectionId:   connId,
+		requestId:      requestId,
 		connInfoPrefix: connInfoPrefix,
 		bufferSize:     0xffff,
 		secure:         false,
@@ -52,13 +73,63 @@ func (fwd *WebForwarder) SetSNI(sni string) {
 	fwd.sni = sni
 }
 
+// SetBackendH2 offers h2 when dialing a TLS backend and opens the websocket with an extended CONNECT (RFC 8441)
+// when the backend accepts it
+func (fwd *WebForwarder) SetBackendH2(enabled bool) {
+	fwd.backendH2 = enabled
+}
+
+// SetAllowedOrigins rejects websocket requests whose Origin header is not listed, requests without an Origin header
+// (non-browser clients) are allowed, an empty list or "*" allows every origin
+func (fwd *WebForwarder) SetAllowedOrigins(origins []string) {
+	fwd.allowedOrigins = origins
+}
+
+// SetAllowedBackends lets clients pick the backend with an X-Backend-Target header, only the listed host:port
+// targets are dialed, anything else falls back to the default backend
+func (fwd *WebForwarder) SetAllowedBackends(backends []string) {
+	fwd.allowedDsts = backends
+}
+
+// SetProxyProtocol sends a PROXY protocol v1 header with the client address before anything else on backend connections
+func (fwd *WebForwarder) SetProxyProtocol(enabled bool) {
+	fwd.proxyProto = enabled
+}
+
+// SetDialTimeout bounds the backend dial including the TLS handshake, zero waits for the OS timeout
+func (fwd *WebForwarder) SetDialTimeout(d time.Duration) {
+	fwd.dialTimeout = d
+}
+
+// SetConnPool takes backend connections from pool instead of dialing for every session
+func (fwd *WebForwarder) SetConnPool(pool *ConnPool) {
+	fwd.pool = pool
+}
+
+// SetDeflate negotiates permessage-deflate with clients that offer it, the backend keeps receiving uncompressed
+// frames so every message is inflated or deflated by the forwarder
+func (fwd *WebForwarder) SetDeflate(enabled bool) {
+	fwd.deflate = enabled
+}
+
+// SetTunnelLimit counts the session in tunnels and answers 503 when the limit is reached
+func (fwd *WebForwarder) SetTunnelLimit(tunnels *TunnelLimit) {
+	fwd.tunnels = tunnels
+}
+
+func (fwd *WebForwarder) SetLimiter(limiter *IPLimiter) {
+	fwd.limiter = limiter
+}
+
 func (fwd *WebForwarder) Start() {
 	defer CloseConnection(fwd.srcConn)
 
 	fmt.Printf("%s opened from %s\n", fwd.connInfoPrefix, fwd.srcConn.RemoteAddr())
 
 	buff := make([]byte, fwd.bufferSize)
+	fwd.srcConn.SetReadDeadline(time.Now().Add(headReadTimeout))
 	nr, err := fwd.srcConn.Read(buff)
+	fwd.srcConn.SetReadDeadline(time.Time{})
 	b := buff[0:nr]
 
 	var reqArr []string
@@ -71,66 +142,365 @@ func (fwd *WebForwarder) Start() {
 		reqArr = append(reqArr, buffScanner.Text())
 	}
 
+	// health checks are answered before any websocket validation and do not count against the client limits
+	switch requestPath(reqArr) {
+	case "/healthz":
+		body := "ok"
+		if fwd.tunnels != nil {
+			body = fmt.Sprintf("ok active=%d", fwd.tunnels.Active())
+		}
+		fwd.writeResponse("200 OK", body)
+		fmt.Printf("%s closed\n", fwd.connInfoPrefix)
+		return
+	case "/readyz":
+		conn, err := net.DialTimeout("tcp", fwd.dstAddress, fwd.dialTimeout)
+		if err != nil {
+			fwd.writeResponse("503 Service Unavailable", "backend unavailable")
+			fmt.Printf("%s closed\n", fwd.connInfoPrefix)
+			return
+		}
+		conn.Close()
+		fwd.writeResponse("200 OK", "ok")
+		fmt.Printf("%s closed\n", fwd.connInfoPrefix)
+		return
+	}
+
+	if fwd.limiter != nil {
+		if !fwd.limiter.Acquire(fwd.srcConn.RemoteAddr()) {
+			fwd.writeResponse("429 Too Many Requests", "Too many requests")
+			fmt.Printf("%s rate limited\n", fwd.connInfoPrefix)
+			fmt.Printf("%s closed\n", fwd.connInfoPrefix)
+			return
+		}
+		defer fwd.limiter.Release(fwd.srcConn.RemoteAddr())
+	}
+
 	if !isWs {
-		fwd.srcConn.Write([]byte("HTTP/1.1 500 Internal Server Error\r\nConnection: close\r\n\r\nNo valid websocket request"))
+		fwd.writeResponse("500 Internal Server Error", "No valid websocket request")
 		fmt.Printf("%s closed\n", fwd.connInfoPrefix)
 		return
 	}
 
+	if !fwd.originAllowed(requestHeader(reqArr, "origin")) {
+		fwd.writeResponse("403 Forbidden", "Origin not allowed")
+		fmt.Printf("%s rejected origin '%s'\n", fwd.connInfoPrefix, requestHeader(reqArr, "origin"))
+		fmt.Printf("%s closed\n", fwd.connInfoPrefix)
+		return
+	}
+
+	if fwd.tunnels != nil {
+		if !fwd.tunnels.Acquire() {
+			fwd.writeResponse("503 Service Unavailable", "Too many connections")
+			fmt.Printf("%s connection limit reached\n", fwd.connInfoPrefix)
+			fmt.Printf("%s closed\n", fwd.connInfoPrefix)
+			return
+		}
+		defer fwd.tunnels.Release()
+	}
+
 	remoteKind := "ssh"
 	remoteAddress := fwd.dstAddress
 	if strings.Contains(reqArr[0], fmt.Sprintf(" %s ", fwd.trjWsPath)) {
 		remoteAddress = fwd.trjAddress
 		remoteKind = "trojan"
+	} else if target := requestHeader(reqArr, "x-backend-target"); target != "" {
+		if fwd.backendAllowed(target) {
+			remoteAddress = target
+		} else {
+			fmt.Printf("%s backend target '%s' not allowed, using %s\n", fwd.connInfoPrefix, target, remoteAddress)
+		}
 	}
 
 	fmt.Printf("%s websocket (%s) session opened from %s\n", fwd.connInfoPrefix, remoteKind, fwd.srcConn.RemoteAddr())
 
-	if fwd.secure || (!fwd.secure && remoteKind != "ssh") {
-		fwd.dstConn, err = tls.Dial("tcp", remoteAddress, &tls.Config{
-			InsecureSkipVerify: true,
-			ServerName:         fwd.sni,
-		})
-	} else {
-		fwd.dstConn, err = net.Dial("tcp", remoteAddress)
-	}
+	fwd.dstConn, err = fwd.dialBackend(remoteAddress, fwd.secure || (!fwd.secure && remoteKind != "ssh"))
 	if err != nil {
+		fwd.writeResponse("502 Bad Gateway", "Backend unavailable")
 		fmt.Printf("%s cannot connect to backend '%s'\n", fwd.connInfoPrefix, err)
 		return
 	}
-	defer CloseConnection(fwd.dstConn)
+	defer func() { CloseConnection(fwd.dstConn) }()
 
-	// initial forward tcp connection to backend
-	fwd.dstConn.Write(b)
-	fmt.Printf("%s request\n", fwd.connInfoPrefix)
-	fmt.Println(string(b))
+	deflate := fwd.deflate && WSDeflateOffered(requestHeader(reqArr, "sec-websocket-extensions"))
+	var dstReader *bufio.Reader
+	if tlsConn, ok := fwd.dstConn.(*tls.Conn); ok && tlsConn.ConnectionState().NegotiatedProtocol == "h2" {
+		err = fwd.h2Upgrade(reqArr, remoteAddress, deflate)
+		if err != nil {
+			fmt.Printf("%s cannot open h2 websocket stream '%s'\n", fwd.connInfoPrefix, err)
+			return
+		}
+		dstReader = bufio.NewReader(fwd.dstConn)
+	} else {
+		if !deflate {
+			fmt.Printf("%s request\n", fwd.connInfoPrefix)
+			fmt.Println(string(b))
+		}
+		// initial forward tcp connection to backend
+		dstReader, deflate, err = fwd.forwardUpgrade(b, deflate)
+		if err != nil {
+			fmt.Printf("%s cannot forward websocket upgrade '%s'\n", fwd.connInfoPrefix, err)
+			return
+		}
+	}
 
-	go fwd.handleForwardData(fwd.dstConn, fwd.srcConn)
-	go fwd.handleForwardData(fwd.srcConn, fwd.dstConn)
+	if deflate {
+		fmt.Printf("%s permessage-deflate enabled\n", fwd.connInfoPrefix)
+		go func() {
+			WSRelayDeflate(dstReader, fwd.srcConn)
+			fwd.err()
+		}()
+		go func() {
+			WSRelayInflate(bufio.NewReader(fwd.srcConn), fwd.dstConn)
+			fwd.err()
+		}()
+	} else {
+		go fwd.handleForwardData(fwd.dstConn, fwd.srcConn)
+		go fwd.handleForwardData(fwd.srcConn, fwd.dstConn)
+	}
 	<-fwd.errCh
 
 	fmt.Printf("%s closed\n", fwd.connInfoPrefix)
 }
 
+func (fwd *WebForwarder) dialBackend(remoteAddress string, secure bool) (net.Conn, error) {
+	var conn net.Conn
+	var err error
+	if fwd.pool != nil {
+		conn, err = fwd.pool.Get(remoteAddress)
+	} else {
+		conn, err = net.DialTimeout("tcp", remoteAddress, fwd.dialTimeout)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if fwd.proxyProto {
+		_, err = conn.Write([]byte(proxyProtoHeader(fwd.srcConn.RemoteAddr(), fwd.srcConn.LocalAddr())))
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if !secure {
+		return conn, nil
+	}
+
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: true,
+		ServerName:         fwd.sni,
+	}
+	if fwd.backendH2 {
+		tlsConfig.NextProtos = []string{"h2", "http/1.1"}
+	}
+	tlsConn := tls.Client(conn, tlsConfig)
+	if fwd.dialTimeout > 0 {
+		conn.SetDeadline(time.Now().Add(fwd.dialTimeout))
+	}
+	err = tlsConn.Handshake()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
+
+// proxyProtoHeader formats a PROXY protocol v1 header, addresses that are not tcp are sent as UNKNOWN. Both addresses
+// must share the family, an IPv4 address next to an IPv6 one is sent IPv4-mapped
+func proxyProtoHeader(src, dst net.Addr) string {
+	srcAddr, srcOk := src.(*net.TCPAddr)
+	dstAddr, dstOk := dst.(*net.TCPAddr)
+	if !srcOk || !dstOk {
+		return "PROXY UNKNOWN\r\n"
+	}
+	if srcAddr.IP.To4() != nil && dstAddr.IP.To4() != nil {
+		return fmt.Sprintf("PROXY TCP4 %s %s %d %d\r\n", srcAddr.IP, dstAddr.IP, srcAddr.Port, dstAddr.Port)
+	}
+	return fmt.Sprintf("PROXY TCP6 %s %s %d %d\r\n", proxyProtoIPv6(srcAddr.IP), proxyProtoIPv6(dstAddr.IP), srcAddr.Port, dstAddr.Port)
+}
+
+// proxyProtoIPv6 formats ip for a TCP6 header, IPv4 addresses as IPv4-mapped IPv6
+func proxyProtoIPv6(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return "::ffff:" + ip4.String()
+	}
+	return ip.String()
+}
+
+// h2Upgrade replaces the backend connection with an extended CONNECT stream and answers the client upgrade,
+// websocket frames are carried unchanged on both sides
+func (fwd *WebForwarder) h2Upgrade(reqArr []string, remoteAddress string, deflate bool) error {
+	requestLine := strings.Split(reqArr[0], " ")
+	if len(requestLine) < 2 {
+		return fmt.Errorf("invalid request line '%s'", reqArr[0])
+	}
+	authority := requestHeader(reqArr, "host")
+	if authority == "" {
+		authority = remoteAddress
+	}
+
+	h2Conn, err := H2Connect(fwd.dstConn, authority, "websocket", requestLine[1])
+	if err != nil {
+		return err
+	}
+	fwd.dstConn = h2Conn
+
+	extensions := ""
+	if deflate {
+		extensions = fmt.Sprintf("Sec-WebSocket-Extensions: %s\r\n", WSDeflateExtension)
+	}
+	_, err = fwd.srcConn.Write([]byte(fmt.Sprintf("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n%sX-Request-Id: %s\r\n\r\n", WSAcceptKey(requestHeader(reqArr, "sec-websocket-key")), extensions, fwd.requestId)))
+	return err
+}
+
+// forwardUpgrade forwards the request and tags the backend response with the request id. With deflate the request
+// loses its extensions and a 101 response gains permessage-deflate, any other response is passed through and
+// compression stays off. Backends that do not answer with HTTP are passed through unchanged.
+func (fwd *WebForwarder) forwardUpgrade(req []byte, deflate bool) (*bufio.Reader, bool, error) {
+	if deflate {
+		req = removeHeader(req, "sec-websocket-extensions")
+	}
+	_, err := fwd.dstConn.Write(req)
+	if err != nil {
+		return nil, false, err
+	}
+
+	fwd.dstConn.SetReadDeadline(time.Now().Add(headReadTimeout))
+	defer fwd.dstConn.SetReadDeadline(time.Time{})
+	r := bufio.NewReader(fwd.dstConn)
+	var head bytes.Buffer
+	prefix, err := r.Peek(len("HTTP/"))
+	if err != nil {
+		return nil, false, err
+	}
+	if string(prefix) == "HTTP/" {
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return nil, false, err
+			}
+			if line == "\r\n" {
+				break
+			}
+			head.WriteString(line)
+		}
+		head.WriteString(fmt.Sprintf("X-Request-Id: %s\r\n", fwd.requestId))
+
+		if deflate && strings.HasPrefix(head.String(), "HTTP/1.1 101") {
+			head.WriteString(fmt.Sprintf("Sec-WebSocket-Extensions: %s\r\n\r\n", WSDeflateExtension))
+			_, err = fwd.srcConn.Write(head.Bytes())
+			if err != nil {
+				return nil, false, err
+			}
+			return r, true, nil
+		}
+		head.WriteString("\r\n")
+	}
+
+	buffered, _ := r.Peek(r.Buffered())
+	head.Write(buffered)
+	_, err = fwd.srcConn.Write(head.Bytes())
+	return nil, false, err
+}
+
+func (fwd *WebForwarder) writeResponse(status, body string) {
+	fwd.srcConn.Write([]byte(fmt.Sprintf("HTTP/1.1 %s\r\nConnection: close\r\nContent-Length: %d\r\nX-Request-Id: %s\r\n\r\n%s", status, len(body), fwd.requestId, body)))
+}
+
+func (fwd *WebForwarder) backendAllowed(target string) bool {
+	for _, allowed := range fwd.allowedDsts {
+		if strings.EqualFold(allowed, target) {
+			return true
+		}
+	}
+	return false
+}
+
+func (fwd *WebForwarder) originAllowed(origin string) bool {
+	if origin == "" || len(fwd.allowedOrigins) == 0 {
+		return true
+	}
+	for _, allowed := range fwd.allowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// requestPath returns the path of the request line without the query
+func requestPath(reqArr []string) string {
+	if len(reqArr) == 0 {
+		return ""
+	}
+	requestLine := strings.Split(reqArr[0], " ")
+	if len(requestLine) < 2 {
+		return ""
+	}
+	return strings.SplitN(requestLine[1], "?", 2)[0]
+}
+
+// removeHeader drops every header named name (lowercase) from the head of req
+func removeHeader(req []byte, name string) []byte {
+	headEnd := bytes.Index(req, []byte("\r\n\r\n"))
+	if headEnd < 0 {
+		return req
+	}
+	var out []byte
+	for i, line := range bytes.Split(req[:headEnd], []byte("\r\n")) {
+		kv := bytes.SplitN(line, []byte(":"), 2)
+		if i > 0 && len(kv) == 2 && strings.ToLower(string(bytes.TrimSpace(kv[0]))) == name {
+			continue
+		}
+		out = append(out, line...)
+		out = append(out, '\r', '\n')
+	}
+	return append(out, req[headEnd+2:]...)
+}
+
+// requestHeader returns the value of the first header named name (lowercase) in the request lines
+func requestHeader(reqArr []string, name string) string {
+	if len(reqArr) == 0 {
+		return ""
+	}
+	for _, line := range reqArr[1:] {
+		kv := strings.SplitN(line, ":", 2)
+		if len(kv) == 2 && strings.ToLower(strings.TrimSpace(kv[0])) == name {
+			return strings.TrimSpace(kv[1])
+		}
+	}
+	return ""
+}
+
 func (fwd *WebForwarder) handleForwardData(src net.Conn, dst net.Conn) {
 	buff := make([]byte, fwd.bufferSize)
 	for {
 		nr, err := src.Read(buff)
 		if err != nil {
-			//fmt.Printf("Cannot read buffer '%s'\n", err)
+			if err != io.EOF && !fwd.erred {
+				fmt.Printf("%s cannot read buffer '%s'\n", fwd.connInfoPrefix, err)
+			}
 			fwd.err()
 			return
 		}
 		b := buff[0:nr]
 		nr, err = dst.Write(b)
 		if err != nil {
-			//fmt.Printf("Cannot write buffer '%s'\n", err)
+			if !fwd.erred {
+				fmt.Printf("%s cannot write buffer '%s'\n", fwd.connInfoPrefix, err)
+			}
 			fwd.err()
 			return
 		}
 	}
 }
 
+// newRequestId returns a short random id to correlate the log lines of a connection
+func newRequestId() string {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
 func (fwd *WebForwarder) err() {
 	if fwd.erred {
 		return
@@ -0,0 +1,221 @@
+package tcp
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+const (
+	WSOpContinuation = 0x0
+	WSOpText         = 0x1
+	WSOpBinary       = 0x2
+	WSOpClose        = 0x8
+	WSOpPing         = 0x9
+	WSOpPong         = 0xa
+
+	wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+)
+
+// WSConn carries a byte stream as binary websocket messages over conn
+type WSConn struct {
+	net.Conn
+	r         *bufio.Reader
+	client    bool
+	remaining uint64
+	masked    bool
+	mask      [4]byte
+	maskPos   int
+	wMu       sync.Mutex
+}
+
+func NewWSConn(conn net.Conn, r *bufio.Reader, client bool) *WSConn {
+	if r == nil {
+		r = bufio.NewReader(conn)
+	}
+	return &WSConn{
+		Conn:   conn,
+		r:      r,
+		client: client,
+	}
+}
+
+func WSAcceptKey(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key + wsGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// WSClientHandshake performs the opening handshake on conn and returns a framed connection
+func WSClientHandshake(conn net.Conn, host, path string) (*WSConn, error) {
+	nonce := make([]byte, 16)
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(nonce)
+
+	req := fmt.Sprintf("GET %s HTTP/1.1\r\nHost: %s\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Key: %s\r\nSec-WebSocket-Version: 13\r\n\r\n", path, host, key)
+	_, err = conn.Write([]byte(req))
+	if err != nil {
+		return nil, err
+	}
+
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return nil, fmt.Errorf("unexpected websocket handshake status '%s'", resp.Status)
+	}
+	if !strings.EqualFold(resp.Header.Get("Upgrade"), "websocket") {
+		return nil, errors.New("websocket upgrade header missing")
+	}
+	if resp.Header.Get("Sec-WebSocket-Accept") != WSAcceptKey(key) {
+		return nil, errors.New("invalid websocket accept key")
+	}
+
+	return NewWSConn(conn, r, true), nil
+}
+
+func (c *WSConn) Read(b []byte) (int, error) {
+	for c.remaining == 0 {
+		err := c.nextFrame()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if uint64(len(b)) > c.remaining {
+		b = b[:c.remaining]
+	}
+	n, err := c.r.Read(b)
+	if c.masked {
+		for i := 0; i < n; i++ {
+			b[i] ^= c.mask[c.maskPos%4]
+			c.maskPos++
+		}
+	}
+	c.remaining -= uint64(n)
+	return n, err
+}
+
+func (c *WSConn) Write(b []byte) (int, error) {
+	err := c.WriteFrame(WSOpBinary, b)
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *WSConn) WriteFrame(opcode byte, payload []byte) error {
+	frame := make([]byte, 0, len(payload)+14)
+	frame = append(frame, 0x80|opcode)
+
+	maskBit := byte(0)
+	if c.client {
+		maskBit = 0x80
+	}
+	switch {
+	case len(payload) <= 125:
+		frame = append(frame, maskBit|byte(len(payload)))
+	case len(payload) <= 0xffff:
+		frame = append(frame, maskBit|126, 0, 0)
+		binary.BigEndian.PutUint16(frame[len(frame)-2:], uint16(len(payload)))
+	default:
+		frame = append(frame, maskBit|127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(frame[len(frame)-8:], uint64(len(payload)))
+	}
+
+	if c.client {
+		var mask [4]byte
+		_, err := rand.Read(mask[:])
+		if err != nil {
+			return err
+		}
+		frame = append(frame, mask[:]...)
+		offset := len(frame)
+		frame = append(frame, payload...)
+		for i := range payload {
+			frame[offset+i] ^= mask[i%4]
+		}
+	} else {
+		frame = append(frame, payload...)
+	}
+
+	c.wMu.Lock()
+	defer c.wMu.Unlock()
+	_, err := c.Conn.Write(frame)
+	return err
+}
+
+func (c *WSConn) nextFrame() error {
+	var header [2]byte
+	_, err := io.ReadFull(c.r, header[:])
+	if err != nil {
+		return err
+	}
+	opcode := header[0] & 0x0f
+	c.masked = header[1]&0x80 != 0
+
+	length := uint64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		_, err = io.ReadFull(c.r, ext[:])
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		_, err = io.ReadFull(c.r, ext[:])
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if err != nil {
+		return err
+	}
+	if c.masked {
+		_, err = io.ReadFull(c.r, c.mask[:])
+		if err != nil {
+			return err
+		}
+	}
+	c.maskPos = 0
+
+	switch opcode {
+	case WSOpContinuation, WSOpText, WSOpBinary:
+		c.remaining = length
+		return nil
+	case WSOpClose:
+		c.WriteFrame(WSOpClose, nil)
+		return io.EOF
+	case WSOpPing, WSOpPong:
+		if length > 125 {
+			return errors.New("websocket control frame too large")
+		}
+		payload := make([]byte, length)
+		_, err = io.ReadFull(c.r, payload)
+		if err != nil {
+			return err
+		}
+		if c.masked {
+			for i := range payload {
+				payload[i] ^= c.mask[i%4]
+			}
+		}
+		if opcode == WSOpPing {
+			return c.WriteFrame(WSOpPong, payload)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported websocket opcode %d", opcode)
+	}
+}
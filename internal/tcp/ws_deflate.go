@@ -0,0 +1,237 @@
+package tcp
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+// permessage-deflate (RFC 7692) without context takeover, every message is compressed on its own
+const (
+	WSDeflateExtension = "permessage-deflate; server_no_context_takeover; client_no_context_takeover"
+
+	wsMaxMessageSize = 16 << 20
+)
+
+var (
+	wsDeflateTail      = []byte{0x00, 0x00, 0xff, 0xff}
+	errWSMessageTooBig = errors.New("websocket message too large")
+)
+
+type wsFrame struct {
+	fin     bool
+	rsv1    bool
+	opcode  byte
+	payload []byte
+}
+
+// WSDeflateOffered reports whether the client offered permessage-deflate in its extensions header
+func WSDeflateOffered(extensions string) bool {
+	for _, ext := range strings.Split(extensions, ",") {
+		if strings.TrimSpace(strings.SplitN(ext, ";", 2)[0]) == "permessage-deflate" {
+			return true
+		}
+	}
+	return false
+}
+
+// WSRelayInflate reads compressed messages from a client and writes them uncompressed and masked to dst
+func WSRelayInflate(src *bufio.Reader, dst io.Writer) error {
+	return wsRelay(src, dst, true, func(payload []byte) ([]byte, bool, error) {
+		payload, err := wsInflate(payload)
+		return payload, false, err
+	})
+}
+
+// WSRelayDeflate reads uncompressed messages from a backend and writes them compressed to the client dst
+func WSRelayDeflate(src *bufio.Reader, dst io.Writer) error {
+	return wsRelay(src, dst, false, func(payload []byte) ([]byte, bool, error) {
+		payload, err := wsDeflate(payload)
+		return payload, true, err
+	})
+}
+
+// wsRelay reassembles data messages and passes them through transform, control frames are forwarded as they come
+func wsRelay(src *bufio.Reader, dst io.Writer, mask bool, transform func([]byte) ([]byte, bool, error)) error {
+	var message *wsFrame
+	for {
+		f, err := readWSFrame(src)
+		if err != nil {
+			return err
+		}
+		if f.opcode >= WSOpClose {
+			err = writeWSFrame(dst, f, mask)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		if f.opcode != WSOpContinuation {
+			message = f
+		} else if message != nil {
+			message.payload = append(message.payload, f.payload...)
+		}
+		if message == nil {
+			return errors.New("unexpected websocket continuation frame")
+		}
+		if len(message.payload) > wsMaxMessageSize {
+			return errWSMessageTooBig
+		}
+		if !f.fin {
+			continue
+		}
+
+		// inflate only touches compressed messages, deflate compresses every message
+		if message.rsv1 || !mask {
+			message.payload, message.rsv1, err = transform(message.payload)
+			if err != nil {
+				return err
+			}
+		}
+		message.fin = true
+		err = writeWSFrame(dst, message, mask)
+		if err != nil {
+			return err
+		}
+		message = nil
+	}
+}
+
+func readWSFrame(r *bufio.Reader) (*wsFrame, error) {
+	var header [2]byte
+	_, err := io.ReadFull(r, header[:])
+	if err != nil {
+		return nil, err
+	}
+	f := &wsFrame{
+		fin:    header[0]&0x80 != 0,
+		rsv1:   header[0]&0x40 != 0,
+		opcode: header[0] & 0x0f,
+	}
+
+	length := uint64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		_, err = io.ReadFull(r, ext[:])
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		_, err = io.ReadFull(r, ext[:])
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if err != nil {
+		return nil, err
+	}
+	if length > wsMaxMessageSize {
+		return nil, errWSMessageTooBig
+	}
+
+	var mask [4]byte
+	masked := header[1]&0x80 != 0
+	if masked {
+		_, err = io.ReadFull(r, mask[:])
+		if err != nil {
+			return nil, err
+		}
+	}
+	// the payload grows as it arrives, a peer announcing a large frame cannot make us allocate it upfront
+	var payload bytes.Buffer
+	_, err = io.CopyN(&payload, r, int64(length))
+	if err != nil {
+		return nil, err
+	}
+	f.payload = payload.Bytes()
+	if masked {
+		for i := range f.payload {
+			f.payload[i] ^= mask[i%4]
+		}
+	}
+	return f, nil
+}
+
+func writeWSFrame(w io.Writer, f *wsFrame, mask bool) error {
+	frame := make([]byte, 0, len(f.payload)+14)
+	first := f.opcode
+	if f.fin {
+		first |= 0x80
+	}
+	if f.rsv1 {
+		first |= 0x40
+	}
+	frame = append(frame, first)
+
+	maskBit := byte(0)
+	if mask {
+		maskBit = 0x80
+	}
+	switch {
+	case len(f.payload) <= 125:
+		frame = append(frame, maskBit|byte(len(f.payload)))
+	case len(f.payload) <= 0xffff:
+		frame = append(frame, maskBit|126, 0, 0)
+		binary.BigEndian.PutUint16(frame[len(frame)-2:], uint16(len(f.payload)))
+	default:
+		frame = append(frame, maskBit|127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(frame[len(frame)-8:], uint64(len(f.payload)))
+	}
+
+	if mask {
+		var key [4]byte
+		_, err := rand.Read(key[:])
+		if err != nil {
+			return err
+		}
+		frame = append(frame, key[:]...)
+		offset := len(frame)
+		frame = append(frame, f.payload...)
+		for i := range f.payload {
+			frame[offset+i] ^= key[i%4]
+		}
+	} else {
+		frame = append(frame, f.payload...)
+	}
+
+	_, err := w.Write(frame)
+	return err
+}
+
+func wsDeflate(b []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	fw, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+	_, err = fw.Write(b)
+	if err != nil {
+		return nil, err
+	}
+	err = fw.Flush()
+	if err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), wsDeflateTail), nil
+}
+
+func wsInflate(b []byte) ([]byte, error) {
+	fr := flate.NewReader(io.MultiReader(bytes.NewReader(b), bytes.NewReader(wsDeflateTail)))
+	defer fr.Close()
+	out, err := ioutil.ReadAll(io.LimitReader(fr, wsMaxMessageSize+1))
+	if err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(out) > wsMaxMessageSize {
+		return nil, errWSMessageTooBig
+	}
+	return out, nil
+}
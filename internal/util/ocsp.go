@@ -0,0 +1,125 @@
+package util
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/ocsp"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	ocspMinInterval     = time.Minute
+	ocspRetryInterval   = 10 * time.Minute
+	ocspDefaultInterval = time.Hour
+)
+
+// OCSPStapler serves a certificate with a stapled OCSP response that is refreshed before it expires
+type OCSPStapler struct {
+	mu     sync.RWMutex
+	cert   *tls.Certificate
+	leaf   *x509.Certificate
+	issuer *x509.Certificate
+	// consecutive fetch failures, each doubles the retry interval
+	failures uint
+}
+
+func NewOCSPStapler(cert tls.Certificate) (*OCSPStapler, error) {
+	if len(cert.Certificate) < 2 {
+		return nil, errors.New("certificate chain has no issuer")
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	if len(leaf.OCSPServer) == 0 {
+		return nil, errors.New("certificate has no OCSP server")
+	}
+	issuer, err := x509.ParseCertificate(cert.Certificate[1])
+	if err != nil {
+		return nil, err
+	}
+	return &OCSPStapler{
+		cert:   &cert,
+		leaf:   leaf,
+		issuer: issuer,
+	}, nil
+}
+
+func (s *OCSPStapler) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.cert, nil
+}
+
+// Start fetches the first response synchronously and keeps refreshing it in the background
+func (s *OCSPStapler) Start() {
+	next := s.refresh()
+	go func() {
+		for {
+			time.Sleep(time.Until(next))
+			next = s.refresh()
+		}
+	}()
+}
+
+func (s *OCSPStapler) refresh() time.Time {
+	resp, raw, err := s.fetch()
+	if err != nil {
+		fmt.Printf("Cannot fetch OCSP response '%s'\n", err)
+		retry := ocspMinInterval << s.failures
+		if retry >= ocspRetryInterval {
+			retry = ocspRetryInterval
+		} else {
+			s.failures++
+		}
+		return time.Now().Add(retry)
+	}
+	s.failures = 0
+
+	s.mu.Lock()
+	cert := *s.cert
+	cert.OCSPStaple = raw
+	s.cert = &cert
+	s.mu.Unlock()
+
+	// refresh halfway through the validity window, a stale or short window must not refresh in a tight loop
+	if resp.NextUpdate.IsZero() {
+		return time.Now().Add(ocspDefaultInterval)
+	}
+	next := resp.ThisUpdate.Add(resp.NextUpdate.Sub(resp.ThisUpdate) / 2)
+	if earliest := time.Now().Add(ocspMinInterval); next.Before(earliest) {
+		return earliest
+	}
+	return next
+}
+
+func (s *OCSPStapler) fetch() (*ocsp.Response, []byte, error) {
+	req, err := ocsp.CreateRequest(s.leaf, s.issuer, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	client := &http.Client{Timeout: 30 * time.Second}
+	httpResp, err := client.Post(s.leaf.OCSPServer[0], "application/ocsp-request", bytes.NewReader(req))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("unexpected OCSP status %s", httpResp.Status)
+	}
+	raw, err := ioutil.ReadAll(httpResp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	resp, err := ocsp.ParseResponseForCert(raw, s.leaf, s.issuer)
+	if err != nil {
+		return nil, nil, err
+	}
+	return resp, raw, nil
+}
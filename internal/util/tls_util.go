@@ -2,90 +2,170 @@ package util
 
 import (
 	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/rand"
-	"crypto/rsa"
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/pem"
+	"io/ioutil"
 	"math/big"
 	"net"
+	"os"
+	"path/filepath"
 	"time"
 )
 
+// cached self-signed certificates are regenerated when they expire within this period
+const tlsCacheRenewBefore = 30 * 24 * time.Hour
+
 const (
 	TLSCerTypeCA   = 0
 	TLSCerTypeCert = 1
 )
 
-func TLSGenerateConfig() (serverTLSConf *tls.Config, clientTLSConf *tls.Config, err error) {
-	ca := TLSGenerateX509Cer(TLSCerTypeCA)
+// TLSGenerateConfig generates a self-signed ECDSA P-256 CA and a leaf certificate valid for loopback and the given domains,
+// a "*" domain generates the leaf for localhost only
+func TLSGenerateConfig(domains ...string) (serverTLSConf *tls.Config, clientTLSConf *tls.Config, err error) {
+	caPEM, certPEM, certPrivateKeyPEM, err := tlsGeneratePEM(domains...)
+	if err != nil {
+		return nil, nil, err
+	}
 
-	caPrivateKey, err := rsa.GenerateKey(rand.Reader, 4096)
+	serverCert, err := tls.X509KeyPair(certPEM, certPrivateKeyPEM)
 	if err != nil {
 		return nil, nil, err
 	}
 
+	serverTLSConf = &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+	}
+
+	certPool := x509.NewCertPool()
+	certPool.AppendCertsFromPEM(caPEM)
+	clientTLSConf = &tls.Config{
+		RootCAs: certPool,
+	}
+
+	return
+}
+
+// TLSCachedConfig reuses the self-signed certificate stored in cacheDir, a new one is generated and stored
+// when it is missing, does not cover the domains or expires within tlsCacheRenewBefore
+func TLSCachedConfig(cacheDir string, domains ...string) (*tls.Config, error) {
+	certFile := filepath.Join(cacheDir, "cert.pem")
+	keyFile := filepath.Join(cacheDir, "key.pem")
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err == nil && tlsCachedCertValid(cert, domains) {
+		return &tls.Config{
+			Certificates: []tls.Certificate{cert},
+		}, nil
+	}
+
+	caPEM, certPEM, certPrivateKeyPEM, err := tlsGeneratePEM(domains...)
+	if err != nil {
+		return nil, err
+	}
+	cert, err = tls.X509KeyPair(certPEM, certPrivateKeyPEM)
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.MkdirAll(cacheDir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	err = ioutil.WriteFile(filepath.Join(cacheDir, "ca.pem"), caPEM, 0644)
+	if err != nil {
+		return nil, err
+	}
+	err = ioutil.WriteFile(certFile, certPEM, 0644)
+	if err != nil {
+		return nil, err
+	}
+	err = ioutil.WriteFile(keyFile, certPrivateKeyPEM, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	}, nil
+}
+
+func tlsCachedCertValid(cert tls.Certificate, domains []string) bool {
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return false
+	}
+	if time.Now().Add(tlsCacheRenewBefore).After(leaf.NotAfter) {
+		return false
+	}
+	for _, domain := range domains {
+		if domain == "*" {
+			domain = "localhost"
+		}
+		if leaf.VerifyHostname(domain) != nil {
+			return false
+		}
+	}
+	return true
+}
+
+func tlsGeneratePEM(domains ...string) (caPEM, certPEM, certPrivateKeyPEM []byte, err error) {
+	ca := TLSGenerateX509Cer(TLSCerTypeCA)
+
+	caPrivateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
 	caBytes, err := x509.CreateCertificate(rand.Reader, ca, ca, &caPrivateKey.PublicKey, caPrivateKey)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, nil, err
 	}
 
-	caPEM := new(bytes.Buffer)
-	pem.Encode(caPEM, &pem.Block{
+	caBuff := new(bytes.Buffer)
+	pem.Encode(caBuff, &pem.Block{
 		Type:  "CERTIFICATE",
 		Bytes: caBytes,
 	})
 
-	caPrivateKeyPEM := new(bytes.Buffer)
-	pem.Encode(caPrivateKeyPEM, &pem.Block{
-		Type:  "RSA PRIVATE KEY",
-		Bytes: x509.MarshalPKCS1PrivateKey(caPrivateKey),
-	})
-
-	cert := TLSGenerateX509Cer(TLSCerTypeCert)
+	cert := TLSGenerateX509Cer(TLSCerTypeCert, domains...)
 
-	certPrivateKey, err := rsa.GenerateKey(rand.Reader, 4096)
+	certPrivateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, nil, err
 	}
 
 	certBytes, err := x509.CreateCertificate(rand.Reader, cert, ca, &certPrivateKey.PublicKey, caPrivateKey)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, nil, err
 	}
 
-	certPEM := new(bytes.Buffer)
-	pem.Encode(certPEM, &pem.Block{
+	certBuff := new(bytes.Buffer)
+	pem.Encode(certBuff, &pem.Block{
 		Type:  "CERTIFICATE",
 		Bytes: certBytes,
 	})
 
-	certPrivateKeyPEM := new(bytes.Buffer)
-	pem.Encode(certPrivateKeyPEM, &pem.Block{
-		Type:  "RSA PRIVATE KEY",
-		Bytes: x509.MarshalPKCS1PrivateKey(certPrivateKey),
-	})
-
-	serverCert, err := tls.X509KeyPair(certPEM.Bytes(), certPrivateKeyPEM.Bytes())
+	certPrivateKeyBytes, err := x509.MarshalECPrivateKey(certPrivateKey)
 	if err != nil {
-		return nil, nil, err
-	}
-
-	serverTLSConf = &tls.Config{
-		Certificates: []tls.Certificate{serverCert},
+		return nil, nil, nil, err
 	}
 
-	certPool := x509.NewCertPool()
-	certPool.AppendCertsFromPEM(caPEM.Bytes())
-	clientTLSConf = &tls.Config{
-		RootCAs: certPool,
-	}
+	certPrivateKeyBuff := new(bytes.Buffer)
+	pem.Encode(certPrivateKeyBuff, &pem.Block{
+		Type:  "EC PRIVATE KEY",
+		Bytes: certPrivateKeyBytes,
+	})
 
-	return
+	return caBuff.Bytes(), certBuff.Bytes(), certPrivateKeyBuff.Bytes(), nil
 }
 
-func TLSGenerateX509Cer(cerType uint) *x509.Certificate {
+func TLSGenerateX509Cer(cerType uint, domains ...string) *x509.Certificate {
 	cer := &x509.Certificate{
 		SerialNumber: big.NewInt(2022),
 		Subject: pkix.Name{
@@ -111,6 +191,20 @@ func TLSGenerateX509Cer(cerType uint) *x509.Certificate {
 	if cerType == TLSCerTypeCert {
 		cer.KeyUsage = x509.KeyUsageDigitalSignature
 		cer.IPAddresses = []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback}
+		for _, domain := range domains {
+			if domain == "*" {
+				cer.DNSNames = []string{"localhost"}
+				break
+			}
+			if ip := net.ParseIP(domain); ip != nil {
+				cer.IPAddresses = append(cer.IPAddresses, ip)
+				continue
+			}
+			cer.DNSNames = append(cer.DNSNames, domain)
+		}
+		if len(cer.DNSNames) > 0 {
+			cer.Subject.CommonName = cer.DNSNames[0]
+		}
 	}
 
 	return cer
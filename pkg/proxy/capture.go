@@ -0,0 +1,112 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Capture file format, all integers big endian:
+//
+//	header: 8 bytes magic "TPTCAP1\n"
+//	record: 1 byte direction (DirectionOutbound or DirectionInbound), 8 bytes unix nano timestamp,
+//	        4 bytes payload length, payload
+//
+// Payloads are the raw bytes read from each side before any rewrite.
+var captureMagic = []byte("TPTCAP1\n")
+
+type CaptureRecord struct {
+	Direction int
+	Time      time.Time
+	Payload   []byte
+}
+
+type captureWriter struct {
+	mu     sync.Mutex
+	f      *os.File
+	failed bool
+}
+
+// SetCaptureFile records every chunk read from both sides to path, the file is truncated
+func (p *Proxy) SetCaptureFile(path string) error {
+	if p.startedWarn("SetCaptureFile") {
+		return errProxyStarted
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(captureMagic)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	p.capture = &captureWriter{f: f}
+	return nil
+}
+
+// write returns the first error only, the capture stops after it
+func (c *captureWriter) write(direction int, b []byte) error {
+	header := make([]byte, 13)
+	header[0] = byte(direction)
+	binary.BigEndian.PutUint64(header[1:9], uint64(time.Now().UnixNano()))
+	binary.BigEndian.PutUint32(header[9:13], uint32(len(b)))
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.failed {
+		return nil
+	}
+	_, err := c.f.Write(header)
+	if err == nil {
+		_, err = c.f.Write(b)
+	}
+	c.failed = err != nil
+	return err
+}
+
+func (c *captureWriter) close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.failed = true
+	return c.f.Close()
+}
+
+// ReadCapture calls fn for every record of a capture file written by SetCaptureFile
+func ReadCapture(r io.Reader, fn func(record CaptureRecord) error) error {
+	magic := make([]byte, len(captureMagic))
+	_, err := io.ReadFull(r, magic)
+	if err != nil {
+		return err
+	}
+	if string(magic) != string(captureMagic) {
+		return errors.New("not a capture file")
+	}
+
+	header := make([]byte, 13)
+	for {
+		_, err = io.ReadFull(r, header)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		payload := make([]byte, binary.BigEndian.Uint32(header[9:13]))
+		_, err = io.ReadFull(r, payload)
+		if err != nil {
+			return err
+		}
+		err = fn(CaptureRecord{
+			Direction: int(header[0]),
+			Time:      time.Unix(0, int64(binary.BigEndian.Uint64(header[1:9]))),
+			Payload:   payload,
+		})
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// request tokens resolved against the original CONNECT request when lPayload is applied
+var connectTokens = []string{"[raw]", "[method]", "[target]", "[protocol]"}
+
+// SetReplaceConnect controls whether a CONNECT request on client mode is replaced with lPayload (the default),
+// when disabled the original request is forwarded with only its Host line set to the server host.
+// lPayload may merge the original request with the [raw], [method], [target] and [protocol] tokens.
+func (p *Proxy) SetReplaceConnect(enabled bool) {
+	if p.startedWarn("SetReplaceConnect") {
+		return
+	}
+	p.replaceConnect = enabled
+}
+
+// connectPayload resolves the request tokens of lPayload, lPayload is returned as is when it has none
+func (p *Proxy) connectPayload(requestLine string, request []byte) []byte {
+	hasTokens := false
+	for _, token := range connectTokens {
+		if bytes.Contains(p.lPayload, []byte(token)) {
+			hasTokens = true
+			break
+		}
+	}
+	if !hasTokens {
+		return p.lPayload
+	}
+
+	fields := strings.Fields(requestLine)
+	for len(fields) < 3 {
+		fields = append(fields, "")
+	}
+	payload := bytes.Replace(p.lPayload, []byte("[method]"), []byte(fields[0]), -1)
+	payload = bytes.Replace(payload, []byte("[target]"), []byte(fields[1]), -1)
+	payload = bytes.Replace(payload, []byte("[protocol]"), []byte(fields[2]), -1)
+	// [raw] goes last so the original request is not searched for tokens
+	return bytes.Replace(payload, []byte("[raw]"), request, -1)
+}
+
+// rewriteConnectHost sets the Host line of the request head to the server host, a missing Host line is added
+func (p *Proxy) rewriteConnectHost(request []byte) []byte {
+	if p.sHost.HostName == "" {
+		return request
+	}
+	host := fmt.Sprintf("Host: %s:%d", p.sHost.HostName, p.sHost.Port)
+
+	headEnd := bytes.Index(request, []byte("\r\n\r\n"))
+	if headEnd < 0 {
+		return request
+	}
+	lines := strings.Split(string(request[:headEnd]), "\r\n")
+	replaced := false
+	for i := 1; i < len(lines); i++ {
+		if strings.HasPrefix(strings.ToLower(lines[i]), "host:") {
+			lines[i] = host
+			replaced = true
+		}
+	}
+	if !replaced {
+		lines = append(lines[:1], append([]string{host}, lines[1:]...)...)
+	}
+
+	newRequest := []byte(strings.Join(lines, "\r\n"))
+	return append(newRequest, request[headEnd:]...)
+}
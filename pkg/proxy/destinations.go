@@ -0,0 +1,132 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+var errDestinationDenied = errors.New("destination not allowed")
+
+// fatal access_denied TLS alert, sent to SNI routed clients of a denied destination
+var tlsAlertAccessDenied = []byte{0x15, 0x03, 0x01, 0x00, 0x02, 0x02, 0x31}
+
+// destinationPattern matches the remote by CIDR, or by host and port where either may be *
+// and host may be a *.example.com wildcard
+type destinationPattern struct {
+	network *net.IPNet
+	host    string
+	port    string
+}
+
+// SetAllowedDestinations restricts the remotes a connection may dial to patterns, each a CIDR like 10.0.0.0/8,
+// a host or a host:port. Host and port may be *, host may be a *.example.com wildcard matched against the remote host
+// name. It guards modes where the client picks the destination, denied connections are reset, or get a TLS alert
+// when routed by SNI.
+func (p *Proxy) SetAllowedDestinations(patterns []string) error {
+	if p.startedWarn("SetAllowedDestinations") {
+		return errProxyStarted
+	}
+	allowed, err := parseDestinations(patterns)
+	if err != nil {
+		return err
+	}
+	p.allowedDestinations = allowed
+	return nil
+}
+
+// CheckDestinations returns the error SetAllowedDestinations would return for patterns
+func CheckDestinations(patterns []string) error {
+	_, err := parseDestinations(patterns)
+	return err
+}
+
+func parseDestinations(patterns []string) ([]destinationPattern, error) {
+	allowed := make([]destinationPattern, 0, len(patterns))
+	for _, pattern := range patterns {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+		if strings.Contains(pattern, "/") {
+			_, network, err := net.ParseCIDR(pattern)
+			if err != nil {
+				return nil, err
+			}
+			allowed = append(allowed, destinationPattern{network: network})
+			continue
+		}
+		host, port, err := net.SplitHostPort(pattern)
+		if err != nil {
+			// a bare host allows every port
+			host, port = strings.Trim(pattern, "[]"), "*"
+		}
+		if port != "*" {
+			n, err := strconv.Atoi(port)
+			if err != nil || n < 1 || n > 65535 {
+				return nil, fmt.Errorf("invalid port in destination %s", pattern)
+			}
+		}
+		if host == "" {
+			return nil, fmt.Errorf("missing host in destination %s", pattern)
+		}
+		allowed = append(allowed, destinationPattern{host: strings.ToLower(host), port: port})
+	}
+	return allowed, nil
+}
+
+// destinationAllowed matches the resolved remote address and the remote host name against the allowed patterns
+func (p *Proxy) destinationAllowed() bool {
+	hostName := ""
+	if host, _, err := net.SplitHostPort(p.rHost); err == nil && net.ParseIP(host) == nil {
+		hostName = strings.ToLower(strings.TrimSuffix(host, "."))
+	}
+	port := strconv.Itoa(p.rAddr.Port)
+	for _, d := range p.allowedDestinations {
+		if d.network != nil {
+			if d.network.Contains(p.rAddr.IP) {
+				return true
+			}
+			continue
+		}
+		if d.port != "*" && d.port != port {
+			continue
+		}
+		switch {
+		case d.host == "*":
+			return true
+		case net.ParseIP(d.host) != nil:
+			if net.ParseIP(d.host).Equal(p.rAddr.IP) {
+				return true
+			}
+		case strings.HasPrefix(d.host, "*."):
+			if hostName != "" && strings.HasSuffix(hostName, d.host[1:]) {
+				return true
+			}
+		case d.host == hostName:
+			return true
+		}
+	}
+	return false
+}
+
+// rejectDestination answers a denied connection the way its protocol expects
+func (p *Proxy) rejectDestination() {
+	destination := p.rAddr.String()
+	if p.rHost != "" && p.rHost != destination {
+		destination = fmt.Sprintf("%s (%s)", p.rHost, destination)
+	}
+	p.event("destination_denied", errDestinationDenied, "destination %s not allowed, closing", destination)
+
+	if p.sniRouted {
+		p.setWriteDeadline(p.lConn)
+		p.lConn.Write(tlsAlertAccessDenied)
+		return
+	}
+	// reset instead of a clean close so the client does not mistake it for an empty response
+	if tcpConn := tcpConnOf(p.lConn); tcpConn != nil {
+		tcpConn.SetLinger(0)
+	}
+}
@@ -0,0 +1,82 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"fmt"
+	utls "github.com/refraction-networking/utls"
+	"net"
+)
+
+// ClientHellos of browsers sent by uTLS, the Go ClientHello is easy to tell apart and blocked by some DPI
+var tlsFingerprints = map[string]utls.ClientHelloID{
+	"chrome":     utls.HelloChrome_Auto,
+	"firefox":    utls.HelloFirefox_Auto,
+	"ios":        utls.HelloIOS_Auto,
+	"randomized": utls.HelloRandomized,
+}
+
+// SetTLSFingerprint sends the ClientHello of profile, chrome, firefox, ios or randomized, on the remote TLS
+// handshake using uTLS. An empty profile uses crypto/tls.
+func (p *Proxy) SetTLSFingerprint(profile string) error {
+	if p.startedWarn("SetTLSFingerprint") {
+		return errProxyStarted
+	}
+	err := CheckTLSFingerprint(profile)
+	if err != nil {
+		return err
+	}
+	p.tlsFingerprint = profile
+	return nil
+}
+
+// CheckTLSFingerprint returns the error SetTLSFingerprint would return for profile
+func CheckTLSFingerprint(profile string) error {
+	if _, ok := tlsFingerprints[profile]; !ok && profile != "" {
+		return fmt.Errorf("unknown tls fingerprint '%s', use chrome, firefox, ios or randomized", profile)
+	}
+	return nil
+}
+
+// uTLSClient runs the handshake of conn with the ClientHello of the fingerprint profile. The browser profiles
+// offer h2, which only h2-connect speaks, other kinds offer http/1.1 in its place.
+func (p *Proxy) uTLSClient(conn net.Conn, serverName string) (net.Conn, error) {
+	uConn := utls.UClient(conn, &utls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: true,
+	}, tlsFingerprints[p.tlsFingerprint])
+	if p.proxyKind != "h2-connect" {
+		err := uConn.BuildHandshakeState()
+		if err != nil {
+			return nil, err
+		}
+		for _, ext := range uConn.Extensions {
+			if alpn, ok := ext.(*utls.ALPNExtension); ok {
+				alpn.AlpnProtocols = []string{"http/1.1"}
+			}
+		}
+		// marshal the ClientHello again with the changed extension
+		err = uConn.BuildHandshakeState()
+		if err != nil {
+			return nil, err
+		}
+	}
+	err := uConn.Handshake()
+	if err != nil {
+		return nil, err
+	}
+	if protocol := uConn.ConnectionState().NegotiatedProtocol; protocol == "h2" && p.proxyKind != "h2-connect" {
+		return nil, fmt.Errorf("upstream negotiated unsupported ALPN protocol '%s'", protocol)
+	}
+	return uConn, nil
+}
+
+// negotiatedProtocol returns the ALPN protocol of a crypto/tls or uTLS conn, false for other conns
+func negotiatedProtocol(conn net.Conn) (string, bool) {
+	switch c := conn.(type) {
+	case *tls.Conn:
+		return c.ConnectionState().NegotiatedProtocol, true
+	case *utls.UConn:
+		return c.ConnectionState().NegotiatedProtocol, true
+	}
+	return "", false
+}
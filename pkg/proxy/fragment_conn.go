@@ -0,0 +1,34 @@
+package proxy
+
+import (
+	"net"
+)
+
+const tlsFragmentSize = 16
+
+// fragmentConn splits the first write (the TLS ClientHello) across multiple TCP segments
+type fragmentConn struct {
+	net.Conn
+	written bool
+}
+
+func (c *fragmentConn) Write(b []byte) (int, error) {
+	if c.written {
+		return c.Conn.Write(b)
+	}
+	c.written = true
+
+	written := 0
+	for written < len(b) {
+		end := written + tlsFragmentSize
+		if end > len(b) {
+			end = len(b)
+		}
+		n, err := c.Conn.Write(b[written:end])
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
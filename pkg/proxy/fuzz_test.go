@@ -0,0 +1,63 @@
+//go:build go1.18
+// +build go1.18
+
+package proxy
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+// discardConn reads nothing and drops every write, handshake answers of the proxy go nowhere
+type discardConn struct{}
+
+func (discardConn) Read(b []byte) (int, error)         { return 0, io.EOF }
+func (discardConn) Write(b []byte) (int, error)        { return len(b), nil }
+func (discardConn) Close() error                       { return nil }
+func (discardConn) LocalAddr() net.Addr                { return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1} }
+func (discardConn) RemoteAddr() net.Addr               { return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 2} }
+func (discardConn) SetDeadline(t time.Time) error      { return nil }
+func (discardConn) SetReadDeadline(t time.Time) error  { return nil }
+func (discardConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// FuzzHandleOutbound feeds arbitrary first packets to the handshake parsers of both directions
+func FuzzHandleOutbound(f *testing.F) {
+	for _, seed := range []string{
+		"",
+		"\n",
+		"\r\n\r\n",
+		"CONNECT",
+		"CONNECT example.com:443 HTTP/1.1\r\nHost: example.com\r\n\r\n",
+		"GET / HTTP/1.1\r\nUpgrade: websocket\r\nX-Auth-Token: token\r\n\r\n",
+		"GET /\r\nUpgrade: websocket\r\n\r\n",
+		"HTTP/1.1 101 Switching Protocols\r\n\r\n\x01",
+		"HTTP/1.1 101 \r\n\r\n\x00\xff",
+	} {
+		f.Add([]byte(seed))
+	}
+
+	conn := discardConn{}
+	f.Fuzz(func(t *testing.T, packet []byte) {
+		for _, kind := range []string{"ssh", "ws", "h2-connect", "trojan"} {
+			for _, serverMode := range []bool{false, true} {
+				for _, psk := range [][]byte{nil, []byte("psk")} {
+					p := NewProxy(0, conn, nil, nil, false)
+					p.SetLogger(NewJSONLogger(ioutil.Discard))
+					p.SetProxyKind(kind)
+					p.SetServerProxyMode(serverMode)
+					p.SetAuthToken("X-Auth-Token", "token")
+					p.SetPSK(psk)
+					p.SetBufferSize(64)
+
+					connBuff := append([]byte(nil), packet...)
+					p.handleOutboundData(conn, conn, &connBuff)
+					connBuff = append([]byte(nil), packet...)
+					p.handleInboundData(conn, conn, &connBuff)
+				}
+			}
+		}
+	})
+}
@@ -0,0 +1,45 @@
+package proxy
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// handshakeSlots holds the chan struct{} semaphore shared by all proxies, a nil chan means no limit
+var handshakeSlots atomic.Value
+
+// SetMaxHandshakes limits how many proxies dial and handshake with their remote at the same time,
+// Start waits for a slot and releases it once forwarding begins. 0 removes the limit.
+func SetMaxHandshakes(n int) {
+	var slots chan struct{}
+	if n > 0 {
+		slots = make(chan struct{}, n)
+	}
+	handshakeSlots.Store(slots)
+}
+
+// acquireHandshake waits for a handshake slot and returns its release func, nil when the proxy is closed while waiting.
+// The slot goes back to the semaphore it was taken from even if the limit changed meanwhile.
+func (p *Proxy) acquireHandshake() func() {
+	slots, _ := handshakeSlots.Load().(chan struct{})
+	if slots == nil {
+		return func() {}
+	}
+
+	select {
+	case slots <- struct{}{}:
+	default:
+		p.logAt(LevelDebug, "handshake_wait", nil, "waiting for a handshake slot")
+		select {
+		case slots <- struct{}{}:
+		case <-p.errSig:
+			return nil
+		}
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			<-slots
+		})
+	}
+}
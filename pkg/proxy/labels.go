@@ -0,0 +1,130 @@
+package proxy
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// maxLabelSets caps the distinct label sets kept for metrics, connections with further sets are counted
+// under overflowLabelKey so per-connection values like a client ip cannot grow the metrics without bound
+const maxLabelSets = 256
+
+const overflowLabelKey = "_overflow"
+
+// LabelStat is the connection and byte count of the proxies sharing one label set
+type LabelStat struct {
+	Labels        map[string]string `json:"labels"`
+	Active        int64             `json:"active"`
+	Total         uint64            `json:"total"`
+	BytesSent     uint64            `json:"bytes_sent"`
+	BytesReceived uint64            `json:"bytes_received"`
+}
+
+type labelCounters struct {
+	labels        map[string]string
+	active        int64
+	total         uint64
+	bytesSent     uint64
+	bytesReceived uint64
+}
+
+var labelStats = struct {
+	mu   sync.Mutex
+	sets map[string]*labelCounters
+}{
+	sets: make(map[string]*labelCounters),
+}
+
+// SetLabels attaches key-value labels to the proxy, they are added to every log event, the connection info
+// and the per label set counters returned by LabelStats. Keep values low cardinality, tenant or service
+// names rather than client addresses
+func (p *Proxy) SetLabels(labels map[string]string) {
+	if p.startedWarn("SetLabels") {
+		return
+	}
+	p.labels = copyLabels(labels)
+	p.updateConnInfoPrefix()
+}
+
+// Labels returns a copy of the labels set with SetLabels
+func (p *Proxy) Labels() map[string]string {
+	return copyLabels(p.labels)
+}
+
+// LabelStats returns the counters of every label set seen so far sorted by label set
+func LabelStats() []LabelStat {
+	labelStats.mu.Lock()
+	defer labelStats.mu.Unlock()
+	keys := make([]string, 0, len(labelStats.sets))
+	for key := range labelStats.sets {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	stats := make([]LabelStat, 0, len(keys))
+	for _, key := range keys {
+		c := labelStats.sets[key]
+		stats = append(stats, LabelStat{
+			Labels:        copyLabels(c.labels),
+			Active:        atomic.LoadInt64(&c.active),
+			Total:         atomic.LoadUint64(&c.total),
+			BytesSent:     atomic.LoadUint64(&c.bytesSent),
+			BytesReceived: atomic.LoadUint64(&c.bytesReceived),
+		})
+	}
+	return stats
+}
+
+// labelCountersFor returns the counters of labels, creating them unless maxLabelSets is reached
+func labelCountersFor(labels map[string]string) *labelCounters {
+	key := labelKey(labels)
+	labelStats.mu.Lock()
+	defer labelStats.mu.Unlock()
+	c, ok := labelStats.sets[key]
+	if ok {
+		return c
+	}
+	if len(labelStats.sets) >= maxLabelSets {
+		key = overflowLabelKey
+		labels = map[string]string{overflowLabelKey: "true"}
+		if c, ok = labelStats.sets[key]; ok {
+			return c
+		}
+	}
+	c = &labelCounters{labels: copyLabels(labels)}
+	labelStats.sets[key] = c
+	return c
+}
+
+func (c *labelCounters) open() {
+	atomic.AddInt64(&c.active, 1)
+	atomic.AddUint64(&c.total, 1)
+}
+
+func (c *labelCounters) close(p *Proxy) {
+	atomic.AddInt64(&c.active, -1)
+	atomic.AddUint64(&c.bytesSent, atomic.LoadUint64(&p.bytesSent))
+	atomic.AddUint64(&c.bytesReceived, atomic.LoadUint64(&p.bytesReceived))
+}
+
+// labelKey is the sorted k=v list of labels, equal sets share a key
+func labelKey(labels map[string]string) string {
+	pairs := make([]string, 0, len(labels))
+	for k, v := range labels {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func copyLabels(labels map[string]string) map[string]string {
+	if len(labels) == 0 {
+		return nil
+	}
+	labelsCopy := make(map[string]string, len(labels))
+	for k, v := range labels {
+		labelsCopy[k] = v
+	}
+	return labelsCopy
+}
@@ -0,0 +1,47 @@
+package proxy
+
+import (
+	"net"
+)
+
+// SetLinger sets SO_LINGER on both TCP connections. A negative value keeps the system default, close returns at once
+// and unsent data is flushed in the background. 0 discards unsent data and resets the connection (RST) on close,
+// a positive value blocks close up to that many seconds while unsent data is flushed, then resets.
+//
+// The option belongs to the TCP socket under any TLS layer, the remote socket is set before its handshake. A local
+// conn accepted over TLS only exposes its socket on Go 1.18 and later, on older Go it keeps the system default.
+func (p *Proxy) SetLinger(seconds int) {
+	if p.startedWarn("SetLinger") {
+		return
+	}
+	p.linger = seconds
+}
+
+// applyLinger sets the linger of SetLinger on the socket under conn, the system default is left untouched
+func (p *Proxy) applyLinger(conn net.Conn) {
+	if p.linger < 0 {
+		return
+	}
+	if tcpConn := tcpConnOf(conn); tcpConn != nil {
+		tcpConn.SetLinger(p.linger)
+	}
+}
+
+// tcpConnOf returns the TCP socket under conn, nil when a wrapper hides it
+func tcpConnOf(conn net.Conn) *net.TCPConn {
+	for {
+		switch c := conn.(type) {
+		case *net.TCPConn:
+			return c
+		case *PeekConn:
+			conn = c.Conn
+		case *fragmentConn:
+			conn = c.Conn
+		case interface{ NetConn() net.Conn }:
+			// *tls.Conn since Go 1.18
+			conn = c.NetConn()
+		default:
+			return nil
+		}
+	}
+}
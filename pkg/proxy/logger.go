@@ -0,0 +1,84 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	LevelDebug = "debug"
+	LevelInfo  = "info"
+	LevelWarn  = "warn"
+	LevelError = "error"
+)
+
+type Event struct {
+	Level                    string            `json:"level"`
+	ConnId                   uint64            `json:"conn_id"`
+	Event                    string            `json:"event"`
+	Local                    string            `json:"local"`
+	Remote                   string            `json:"remote"`
+	BytesSent                uint64            `json:"bytes_sent"`
+	BytesReceived            uint64            `json:"bytes_received"`
+	DialLatency              time.Duration     `json:"dial_latency,omitempty"`
+	FirstByteSentLatency     time.Duration     `json:"first_byte_sent_latency,omitempty"`
+	FirstByteReceivedLatency time.Duration     `json:"first_byte_received_latency,omitempty"`
+	ProxyKind                string            `json:"proxy_kind"`
+	TLS                      bool              `json:"tls"`
+	Labels                   map[string]string `json:"labels,omitempty"`
+	Timestamp                time.Time         `json:"timestamp"`
+	Error                    string            `json:"error,omitempty"`
+	Message                  string            `json:"-"`
+}
+
+// Logger receives connection events and free-form debug output (packet dumps)
+type Logger interface {
+	Event(e *Event)
+	Printf(format string, v ...interface{})
+}
+
+type TextLogger struct {
+	Debug bool
+}
+
+func (l *TextLogger) Event(e *Event) {
+	if e.Level == LevelDebug && !l.Debug {
+		return
+	}
+	fmt.Println(e.Message)
+}
+
+func (l *TextLogger) Printf(format string, v ...interface{}) {
+	fmt.Printf(format, v...)
+}
+
+type JSONLogger struct {
+	Debug bool
+	mu    sync.Mutex
+	w     io.Writer
+}
+
+func NewJSONLogger(w io.Writer) *JSONLogger {
+	return &JSONLogger{
+		w: w,
+	}
+}
+
+func (l *JSONLogger) Event(e *Event) {
+	if e.Level == LevelDebug && !l.Debug {
+		return
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.w.Write(append(b, '\n'))
+}
+
+// Printf is a no-op, packet dumps are omitted in JSON mode
+func (l *JSONLogger) Printf(format string, v ...interface{}) {}
@@ -0,0 +1,38 @@
+package proxy
+
+import (
+	"sync/atomic"
+)
+
+type RewriteStats struct {
+	Connect   uint64 `json:"connect"`
+	WSUpgrade uint64 `json:"ws_upgrade"`
+	Trojan    uint64 `json:"trojan"`
+	Inbound   uint64 `json:"inbound"`
+}
+
+var rewriteStats RewriteStats
+
+// forwarding goroutines running across all proxies
+var activeForwarders int64
+
+// ActiveForwarders returns how many forwarding goroutines are running across all proxies, an open connection
+// has at most two so a larger count points at forwarders that never exited
+func ActiveForwarders() int64 {
+	return atomic.LoadInt64(&activeForwarders)
+}
+
+// Rewrites returns how many times each payload rewrite path fired across all proxies
+func Rewrites() RewriteStats {
+	return RewriteStats{
+		Connect:   atomic.LoadUint64(&rewriteStats.Connect),
+		WSUpgrade: atomic.LoadUint64(&rewriteStats.WSUpgrade),
+		Trojan:    atomic.LoadUint64(&rewriteStats.Trojan),
+		Inbound:   atomic.LoadUint64(&rewriteStats.Inbound),
+	}
+}
+
+func (p *Proxy) countRewrite(counter *uint64, name string) {
+	atomic.AddUint64(counter, 1)
+	p.logAt(LevelDebug, "rewrite", nil, "applied %s rewrite", name)
+}
@@ -0,0 +1,153 @@
+package proxy
+
+import "net"
+
+// Option configures a Proxy built with New
+type Option func(o *options)
+
+type options struct {
+	connId          uint64
+	secure          bool
+	tlsEnabled      bool
+	sniHost         string
+	frontDomain     string
+	wsHost          string
+	serverHost      string
+	lPayload        string
+	rPayload        string
+	proxyKind       string
+	serverProxyMode bool
+	wsPath          string
+	buffSize        uint64
+	logger          Logger
+	labels          map[string]string
+}
+
+func WithConnId(connId uint64) Option {
+	return func(o *options) {
+		o.connId = connId
+	}
+}
+
+// WithSecureListener marks the local connection as accepted over TLS
+func WithSecureListener() Option {
+	return func(o *options) {
+		o.secure = true
+	}
+}
+
+// WithTLS dials the remote over TLS
+func WithTLS() Option {
+	return func(o *options) {
+		o.tlsEnabled = true
+	}
+}
+
+func WithSNI(host string) Option {
+	return func(o *options) {
+		o.sniHost = host
+	}
+}
+
+func WithFrontDomain(host string) Option {
+	return func(o *options) {
+		o.frontDomain = host
+	}
+}
+
+func WithWSHost(host string) Option {
+	return func(o *options) {
+		o.wsHost = host
+	}
+}
+
+func WithServerHost(server string) Option {
+	return func(o *options) {
+		o.serverHost = server
+	}
+}
+
+func WithPayloads(lPayload, rPayload string) Option {
+	return func(o *options) {
+		o.lPayload = lPayload
+		o.rPayload = rPayload
+	}
+}
+
+func WithProxyKind(proxyKind string) Option {
+	return func(o *options) {
+		o.proxyKind = proxyKind
+	}
+}
+
+func WithServerProxyMode() Option {
+	return func(o *options) {
+		o.serverProxyMode = true
+	}
+}
+
+func WithWSPath(path string) Option {
+	return func(o *options) {
+		o.wsPath = path
+	}
+}
+
+func WithBufferSize(buffSize uint64) Option {
+	return func(o *options) {
+		o.buffSize = buffSize
+	}
+}
+
+func WithLogger(logger Logger) Option {
+	return func(o *options) {
+		o.logger = logger
+	}
+}
+
+func WithLabels(labels map[string]string) Option {
+	return func(o *options) {
+		o.labels = labels
+	}
+}
+
+// New builds a Proxy from opts
+func New(conn net.Conn, lAddr, rAddr *net.TCPAddr, opts ...Option) *Proxy {
+	o := &options{
+		proxyKind: "ssh",
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	p := NewProxy(o.connId, conn, lAddr, rAddr, o.secure)
+	if o.logger != nil {
+		p.SetLogger(o.logger)
+	}
+	if o.serverHost != "" {
+		p.SetServerHost(o.serverHost)
+	}
+	p.SetEnableTLS(o.tlsEnabled)
+	if o.sniHost != "" {
+		p.SetSNIHost(o.sniHost)
+	}
+	if o.frontDomain != "" {
+		p.SetFrontDomain(o.frontDomain)
+	}
+	if o.wsHost != "" {
+		p.SetWSHost(o.wsHost)
+	}
+	p.SetlPayload(o.lPayload)
+	p.SetrPayload(o.rPayload)
+	p.SetServerProxyMode(o.serverProxyMode)
+	if o.wsPath != "" {
+		p.SetWSPath(o.wsPath)
+	}
+	if o.buffSize > 0 {
+		p.SetBufferSize(o.buffSize)
+	}
+	if len(o.labels) > 0 {
+		p.SetLabels(o.labels)
+	}
+	p.SetProxyKind(o.proxyKind)
+	return p
+}
@@ -0,0 +1,60 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// PayloadStep is one request of a multi-step handshake, Send is written to the remote and when WaitFor is set
+// the remote response is read and discarded until it contains WaitFor
+type PayloadStep struct {
+	Send    []byte
+	WaitFor []byte
+}
+
+// SetPayloadSequence runs steps against the remote after it is connected and before forwarding starts,
+// bytes the remote sends after the last awaited pattern are forwarded to the local side like any later response.
+// Every response must arrive within the handshake timeout, or 10 seconds when none is set.
+func (p *Proxy) SetPayloadSequence(steps []PayloadStep) {
+	if p.startedWarn("SetPayloadSequence") {
+		return
+	}
+	p.payloadSequence = steps
+}
+
+func (p *Proxy) runPayloadSequence() error {
+	p.rConn.SetReadDeadline(time.Now().Add(p.headTimeout()))
+	defer p.rConn.SetReadDeadline(time.Time{})
+	var pending []byte
+	buffer := make([]byte, atomic.LoadUint64(&p.buffSize))
+	for i, step := range p.payloadSequence {
+		if len(step.Send) > 0 {
+			_, err := p.rConn.Write(step.Send)
+			if err != nil {
+				return err
+			}
+			p.recordHandshake(step.Send)
+		}
+		if len(step.WaitFor) == 0 {
+			continue
+		}
+		for {
+			if idx := bytes.Index(pending, step.WaitFor); idx >= 0 {
+				pending = pending[idx+len(step.WaitFor):]
+				break
+			}
+			if uint64(len(pending)) >= atomic.LoadUint64(&p.buffSize) {
+				return fmt.Errorf("payload step %d: pattern not found in %d bytes", i+1, len(pending))
+			}
+			n, err := p.rConn.Read(buffer)
+			if err != nil {
+				return err
+			}
+			pending = append(pending, buffer[:n]...)
+		}
+	}
+	p.rPending = pending
+	return nil
+}
@@ -0,0 +1,45 @@
+package proxy
+
+import (
+	"net"
+)
+
+// PeekConn replays bytes already read from Conn before reading from it again, so a connection can be inspected
+// and then forwarded as a whole
+type PeekConn struct {
+	net.Conn
+	buf []byte
+}
+
+// NewPeekConn returns conn with peeked replayed by the first reads
+func NewPeekConn(conn net.Conn, peeked []byte) *PeekConn {
+	return &PeekConn{Conn: conn, buf: peeked}
+}
+
+// Peek reads from Conn until n bytes are buffered and returns them, they are still returned by Read.
+// It returns fewer bytes with the error that stopped the read.
+func (c *PeekConn) Peek(n int) ([]byte, error) {
+	for len(c.buf) < n {
+		buffer := make([]byte, n-len(c.buf))
+		read, err := c.Conn.Read(buffer)
+		c.buf = append(c.buf, buffer[:read]...)
+		if err != nil {
+			return c.buf, err
+		}
+	}
+	return c.buf[:n], nil
+}
+
+// Buffered returns the bytes not replayed yet
+func (c *PeekConn) Buffered() []byte {
+	return c.buf
+}
+
+func (c *PeekConn) Read(b []byte) (int, error) {
+	if len(c.buf) > 0 {
+		n := copy(b, c.buf)
+		c.buf = c.buf[n:]
+		return n, nil
+	}
+	return c.Conn.Read(b)
+}
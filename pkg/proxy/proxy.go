@@ -2,38 +2,138 @@ package proxy
 
 import (
 	"bufio"
+	"bytes"
+	"crypto/subtle"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"github.com/lutfailham96/go-tcp-proxy-tunnel/internal/tcp"
+	"io"
 	"net"
+	"regexp"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	errHandshakeClosed  = errors.New("connection closed during handshake")
+	errProxyStarted     = errors.New("proxy already started")
+	errMalformedRequest = errors.New("malformed request line")
+)
+
+// DefaultRemotePayload is used by SetrPayload when no payload is given, [crlf] tokens are replaced
+var DefaultRemotePayload = "HTTP/1.1 200 Connection Established[crlf][crlf]"
+
+// decoyDialTimeout bounds the decoy backend dial when no dial timeout is set
+const decoyDialTimeout = 5 * time.Second
+
+// headTimeout bounds the handshake reads when no handshake timeout is set: the rest of a buffered head, a payload
+// sequence response or a shadowsocks request. The bytes read so far of a head are forwarded as they are once it passes
+const headTimeout = 10 * time.Second
+
+// stream directions passed to the stream inspector
+const (
+	DirectionOutbound = iota // local to remote
+	DirectionInbound         // remote to local
 )
 
 type Proxy struct {
+	bytesReceived        uint64
+	bytesSent            uint64
+	buffSize             uint64
+	dialLatency          int64
+	firstSentLatency     int64
+	firstReceivedLatency int64
+	lastActivity         int64
 	secure               bool
 	connectionInfoPrefix string
+	logPrefix            string
 	proxyKind            string
 	conn                 net.Conn
 	lConn                net.Conn
 	rConn                net.Conn
+	rConnMu              sync.Mutex
 	lAddr                *net.TCPAddr
 	rAddr                *net.TCPAddr
+	rHost                string
+	dialNetwork          string
+	dialSourceAddr       net.Addr
+	fwMark               int
+	tproxy               bool
 	sHost                tcp.Host
 	tlsEnabled           bool
+	tlsFragment          bool
+	tlsFingerprint       string
+	linger               int
 	sniHost              string
+	frontDomain          string
+	wsHost               string
+	wsPath               string
+	lPayloadTemplate     string
 	lPayload             []byte
 	rPayload             []byte
-	buffSize             uint64
+	splitSize            int
+	splitDelay           time.Duration
+	lWritten             bool
 	lInitialized         bool
 	rInitialized         bool
-	bytesReceived        uint64
-	bytesSent            uint64
-	erred                bool
-	errSig               chan bool
+	rBuff                []byte
+	rHeadExpired         bool
+	lBuff                []byte
+	lHeadExpired         bool
+	errOnce              sync.Once
+	errSig               chan struct{}
+	upgradeSig           chan struct{}
+	done                 chan struct{}
+	activeDirs           int32
+	running              int32
 	connId               uint64
 	serverProxyMode      bool
+	bidirectional        bool
 	wsUpgradeInitialized bool
+	rewriteInbound       bool
+	replaceConnect       bool
+	decoyResponse        []byte
+	decoyBackend         string
+	authHeader           string
+	authToken            string
+	psk                  []byte
+	trojanPassword       string
+	trojanTarget         string
+	ssKey                []byte
+	openGracePeriod      time.Duration
+	handshakeTimeout     time.Duration
+	dialTimeout          time.Duration
+	writeTimeout         time.Duration
+	maxConnDuration      time.Duration
+	statsInterval        time.Duration
+	streamInspector      func(direction int, b []byte) []byte
+	onDial               func(err error)
+	onClose              func(info ConnInfo)
+	labels               map[string]string
+	forwarders           sync.WaitGroup
+	remoteConn           net.Conn
+	sniRoutes            map[string]string
+	sniRouted            bool
+	sniffer              *ProtocolSniffer
+	passthrough          bool
+	allowedDestinations  []destinationPattern
+	payloadSequence      []PayloadStep
+	rPending             []byte
+	replayMu             sync.Mutex
+	replayLimit          int
+	replayBuff           []byte
+	replayTruncated      bool
+	replayFirstWrite     bool
+	outboundRegex        *regexp.Regexp
+	outboundReplacement  []byte
+	capture              *captureWriter
+	logger               Logger
+	registry             *Registry
+	started              time.Time
 }
 
 func NewProxy(connId uint64, conn net.Conn, lAddr, rAddr *net.TCPAddr, secure bool) *Proxy {
@@ -45,18 +145,45 @@ func NewProxy(connId uint64, conn net.Conn, lAddr, rAddr *net.TCPAddr, secure bo
 		rAddr:                rAddr,
 		lPayload:             make([]byte, 0),
 		rPayload:             make([]byte, 0),
+		wsPath:               "/",
+		dialNetwork:          "tcp",
 		buffSize:             uint64(0xffff),
 		lInitialized:         false,
 		rInitialized:         false,
-		erred:                false,
-		errSig:               make(chan bool, 2),
+		errSig:               make(chan struct{}),
+		upgradeSig:           make(chan struct{}),
+		done:                 make(chan struct{}),
 		connId:               connId,
 		serverProxyMode:      false,
 		wsUpgradeInitialized: false,
+		rewriteInbound:       true,
+		replaceConnect:       true,
+		linger:               -1,
+		logger:               &TextLogger{},
+	}
+}
+
+// Setters configure the proxy before Start, once it runs they are ignored with a warning and the ones returning
+// an error return errProxyStarted. SetBufferSize is the only setter that may be called on a running proxy.
+func (p *Proxy) startedWarn(setter string) bool {
+	if atomic.LoadInt32(&p.running) == 0 {
+		return false
 	}
+	p.logAt(LevelWarn, "config_error", errProxyStarted, "%s ignored, proxy already started", setter)
+	return true
 }
 
+// SetlPayload tokens are resolved again whenever the server host or SNI host changes, so setter order does not matter
 func (p *Proxy) SetlPayload(lPayload string) {
+	if p.startedWarn("SetlPayload") {
+		return
+	}
+	p.lPayloadTemplate = lPayload
+	p.resolvelPayload()
+}
+
+func (p *Proxy) resolvelPayload() {
+	lPayload := p.lPayloadTemplate
 	if p.sHost.HostName != "" {
 		lPayload = strings.Replace(lPayload, "[host]", p.sHost.HostName, -1)
 		lPayload = strings.Replace(lPayload, "[host_port]", fmt.Sprintf("%s:%d", p.sHost.HostName, p.sHost.Port), -1)
@@ -69,135 +196,1003 @@ func (p *Proxy) SetlPayload(lPayload string) {
 }
 
 func (p *Proxy) SetrPayload(rPayload string) {
+	if p.startedWarn("SetrPayload") {
+		return
+	}
 	if rPayload == "" {
-		rPayload = "HTTP/1.1 200 Connection Established[crlf][crlf]"
+		rPayload = DefaultRemotePayload
 	}
 	rPayload = strings.Replace(rPayload, "[crlf]", "\r\n", -1)
 	p.rPayload = []byte(rPayload)
 }
 
+// SetRewriteInbound controls whether the first inbound status line is replaced with rPayload on client mode,
+// disable it when the upstream already sends the response the client expects. Disabled, the response is forwarded
+// as read without waiting for complete headers, unless a psk challenge follows it
+func (p *Proxy) SetRewriteInbound(enabled bool) {
+	if p.startedWarn("SetRewriteInbound") {
+		return
+	}
+	p.rewriteInbound = enabled
+}
+
+func (p *Proxy) SetLogger(logger Logger) {
+	if p.startedWarn("SetLogger") {
+		return
+	}
+	p.logger = logger
+}
+
+func (p *Proxy) SetRegistry(registry *Registry) {
+	if p.startedWarn("SetRegistry") {
+		return
+	}
+	p.registry = registry
+}
+
 func (p *Proxy) SetServerProxyMode(enabled bool) {
+	if p.startedWarn("SetServerProxyMode") {
+		return
+	}
 	p.serverProxyMode = enabled
 }
 
+// SetBidirectional forwards both directions from the start on server mode instead of starting the remote to local
+// direction after the websocket upgrade response. Use it for protocols without an upgrade, where the remote may talk
+// first; the upgrade response, auth token, psk and decoy handling are skipped. Leave it off for websocket clients.
+func (p *Proxy) SetBidirectional(enabled bool) {
+	if p.startedWarn("SetBidirectional") {
+		return
+	}
+	p.bidirectional = enabled
+}
+
+// SetDecoyResponse is written back and the connection closed when a server mode request is not a websocket upgrade
+func (p *Proxy) SetDecoyResponse(response []byte) {
+	if p.startedWarn("SetDecoyResponse") {
+		return
+	}
+	p.decoyResponse = response
+}
+
+// SetDecoyBackend transparently forwards server mode requests that are not a websocket upgrade to addr
+func (p *Proxy) SetDecoyBackend(addr string) {
+	if p.startedWarn("SetDecoyBackend") {
+		return
+	}
+	p.decoyBackend = addr
+}
+
+// SetAuthToken requires header to carry value on server mode upgrade requests
+func (p *Proxy) SetAuthToken(header, value string) {
+	if p.startedWarn("SetAuthToken") {
+		return
+	}
+	p.authHeader = header
+	p.authToken = value
+}
+
 func (p *Proxy) SetServerHost(server string) {
+	if p.startedWarn("SetServerHost") {
+		return
+	}
 	sHost, sPort, err := net.SplitHostPort(server)
 	if err != nil {
-		fmt.Printf("%s cannot parse server host port '%s'\n", p.connectionInfoPrefix, err)
+		p.event("error", err, "cannot parse server host port '%s'", err)
 		return
 	}
 	sPortParsed, err := strconv.ParseUint(sPort, 10, 64)
 	if err != nil {
-		fmt.Printf("%s cannot parse server port '%s'\n", p.connectionInfoPrefix, err)
+		p.event("error", err, "cannot parse server port '%s'", err)
 		return
 	}
 	p.sHost = tcp.Host{
 		HostName: sHost,
 		Port:     sPortParsed,
 	}
+	p.resolvelPayload()
+}
+
+func (p *Proxy) SetRemoteHost(host string) {
+	if p.startedWarn("SetRemoteHost") {
+		return
+	}
+	p.rHost = host
+}
+
+// SetRemoteAddr replaces the remote address given to NewProxy, for a remote picked per connection
+func (p *Proxy) SetRemoteAddr(addr *net.TCPAddr) {
+	if p.startedWarn("SetRemoteAddr") {
+		return
+	}
+	p.rAddr = addr
+}
+
+func (p *Proxy) SetDialNetwork(network string) {
+	if p.startedWarn("SetDialNetwork") {
+		return
+	}
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		p.dialNetwork = network
+	default:
+		p.event("error", nil, "unsupported dial network '%s'", network)
+	}
+}
+
+// SetDialSourceAddr binds remote connections to the ip of addr. The port must be 0 or left out, a fixed port
+// fails with EADDRINUSE while another connection to the remote uses it.
+func (p *Proxy) SetDialSourceAddr(addr string) error {
+	if p.startedWarn("SetDialSourceAddr") {
+		return errProxyStarted
+	}
+	sourceAddr, err := resolveDialSourceAddr(addr)
+	if err != nil {
+		return err
+	}
+	p.dialSourceAddr = sourceAddr
+	return nil
+}
+
+// CheckDialSourceAddr returns the error SetDialSourceAddr would return for addr
+func CheckDialSourceAddr(addr string) error {
+	_, err := resolveDialSourceAddr(addr)
+	return err
+}
+
+func resolveDialSourceAddr(addr string) (*net.TCPAddr, error) {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "0")
+	}
+	sourceAddr, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if sourceAddr.Port != 0 {
+		return nil, fmt.Errorf("source address %s has a fixed port, use port 0 or leave it out", addr)
+	}
+	return sourceAddr, nil
+}
+
+// SetFwMark sets SO_MARK on the remote socket for policy routing, linux only
+func (p *Proxy) SetFwMark(mark int) {
+	if p.startedWarn("SetFwMark") {
+		return
+	}
+	p.fwMark = mark
+}
+
+// SetStatsInterval logs the bytes transferred so far every d while the connection is open
+func (p *Proxy) SetStatsInterval(d time.Duration) {
+	if p.startedWarn("SetStatsInterval") {
+		return
+	}
+	p.statsInterval = d
+}
+
+func (p *Proxy) logStats() {
+	ticker := time.NewTicker(p.statsInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.event("stats", nil, "transferred %d bytes sent, %d bytes received", atomic.LoadUint64(&p.bytesSent), atomic.LoadUint64(&p.bytesReceived))
+		case <-p.errSig:
+			return
+		}
+	}
+}
+
+// SetRemoteConn forwards to conn instead of dialing the remote, the dial options and TLS are not applied to it.
+// The caller owns conn until Start, which closes it once the connection ends.
+func (p *Proxy) SetRemoteConn(conn net.Conn) {
+	if p.startedWarn("SetRemoteConn") {
+		return
+	}
+	p.remoteConn = conn
+	if p.rAddr == nil {
+		p.rAddr, _ = conn.RemoteAddr().(*net.TCPAddr)
+	}
+}
+
+// SetOnDial calls fn once the remote dial and its TLS handshake finished, err is nil on success
+func (p *Proxy) SetOnDial(fn func(err error)) {
+	if p.startedWarn("SetOnDial") {
+		return
+	}
+	p.onDial = fn
+}
+
+// SetOnClose calls fn with the final stats of a connection that was opened once forwarding stopped
+func (p *Proxy) SetOnClose(fn func(info ConnInfo)) {
+	if p.startedWarn("SetOnClose") {
+		return
+	}
+	p.onClose = fn
+}
+
+// SetTProxy binds the remote socket to the client ip with IP_TRANSPARENT so the remote sees the real client, linux only
+func (p *Proxy) SetTProxy(enabled bool) {
+	if p.startedWarn("SetTProxy") {
+		return
+	}
+	p.tproxy = enabled
+}
+
+// SetOpenGracePeriod closes the connection when no bytes were transferred within d after Start
+func (p *Proxy) SetOpenGracePeriod(d time.Duration) {
+	if p.startedWarn("SetOpenGracePeriod") {
+		return
+	}
+	p.openGracePeriod = d
+}
+
+// SetHandshakeTimeout closes server mode connections that do not send their handshake, the upgrade request,
+// ClientHello or shadowsocks request, within d after Start. It reaps port scanners and broken clients, zero waits forever.
+// On client mode d bounds the wait for the rest of a held back response head, headTimeout when zero
+func (p *Proxy) SetHandshakeTimeout(d time.Duration) {
+	if p.startedWarn("SetHandshakeTimeout") {
+		return
+	}
+	p.handshakeTimeout = d
+}
+
+// SetDialTimeout bounds the remote and decoy backend dials, zero waits for the OS timeout on the remote and
+// decoyDialTimeout on the decoy backend
+func (p *Proxy) SetDialTimeout(d time.Duration) {
+	if p.startedWarn("SetDialTimeout") {
+		return
+	}
+	p.dialTimeout = d
+}
+
+// clearHandshakeDeadline lifts the handshake timeout once the handshake was read
+func (p *Proxy) clearHandshakeDeadline() {
+	if p.serverProxyMode && p.handshakeTimeout > 0 {
+		p.lConn.SetReadDeadline(time.Time{})
+	}
+}
+
+// SetMaxConnDuration closes the connection d after Start regardless of activity, zero means unlimited
+func (p *Proxy) SetMaxConnDuration(d time.Duration) {
+	if p.startedWarn("SetMaxConnDuration") {
+		return
+	}
+	p.maxConnDuration = d
+}
+
+// SetWriteTimeout closes the connection when a single write to either side blocks longer than d
+func (p *Proxy) SetWriteTimeout(d time.Duration) {
+	if p.startedWarn("SetWriteTimeout") {
+		return
+	}
+	p.writeTimeout = d
+}
+
+// SetStreamInspector calls fn with every forwarded chunk after the handshake rewrites, the returned slice
+// is forwarded instead and may be longer or shorter than b, an empty slice drops the chunk.
+// fn runs inline on the forwarding goroutine so any work it does adds latency to the stream.
+func (p *Proxy) SetStreamInspector(fn func(direction int, b []byte) []byte) {
+	if p.startedWarn("SetStreamInspector") {
+		return
+	}
+	p.streamInspector = fn
+}
+
+// SetOutboundRegexReplace rewrites matches of pattern in the first buffer written to the remote,
+// replacement may reference groups with $1 or ${name}
+func (p *Proxy) SetOutboundRegexReplace(pattern, replacement string) error {
+	if p.startedWarn("SetOutboundRegexReplace") {
+		return errProxyStarted
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return err
+	}
+	p.outboundRegex = re
+	p.outboundReplacement = []byte(replacement)
+	return nil
 }
 
+// SetBufferSize is safe to call on a running proxy, each direction picks up the new size on its next read
 func (p *Proxy) SetBufferSize(buffSize uint64) {
-	p.buffSize = buffSize
+	atomic.StoreUint64(&p.buffSize, buffSize)
+}
+
+// SetPayloadSplit writes the first outbound buffer in chunks of chunkSize with delay in between,
+// zero chunkSize keeps a single write
+func (p *Proxy) SetPayloadSplit(chunkSize int, delay time.Duration) {
+	if p.startedWarn("SetPayloadSplit") {
+		return
+	}
+	p.splitSize = chunkSize
+	p.splitDelay = delay
 }
 
 func (p *Proxy) SetEnableTLS(enabled bool) {
+	if p.startedWarn("SetEnableTLS") {
+		return
+	}
 	p.tlsEnabled = enabled
 }
 
+// SetFrontDomain overrides the SNI presented in the upstream TLS handshake,
+// [sni] and [host] payload tokens keep their own values
+func (p *Proxy) SetFrontDomain(host string) {
+	if p.startedWarn("SetFrontDomain") {
+		return
+	}
+	p.frontDomain = host
+}
+
+// SetWSHost sets the host of the wss:// URL the trojan request path is rewritten to, the SNI host when unset
+func (p *Proxy) SetWSHost(host string) {
+	if p.startedWarn("SetWSHost") {
+		return
+	}
+	p.wsHost = host
+}
+
+func (p *Proxy) SetTLSFragment(enabled bool) {
+	if p.startedWarn("SetTLSFragment") {
+		return
+	}
+	p.tlsFragment = enabled
+}
+
 func (p *Proxy) SetSNIHost(hostname string) {
+	if p.startedWarn("SetSNIHost") {
+		return
+	}
 	p.sniHost = hostname
+	p.resolvelPayload()
+}
+
+func (p *Proxy) SetWSPath(path string) {
+	if p.startedWarn("SetWSPath") {
+		return
+	}
+	if path != "" {
+		p.wsPath = path
+	}
 }
 
 func (p *Proxy) SetProxyKind(proxyKind string) {
+	if p.startedWarn("SetProxyKind") {
+		return
+	}
 	p.proxyKind = proxyKind
+	p.updateConnInfoPrefix()
+}
+
+// SetLogPrefix prepends prefix to the "CONN <kind> #<id>" prefix of every log line
+func (p *Proxy) SetLogPrefix(prefix string) {
+	if p.startedWarn("SetLogPrefix") {
+		return
+	}
+	p.logPrefix = prefix
+	p.updateConnInfoPrefix()
+}
+
+func (p *Proxy) updateConnInfoPrefix() {
 	connInfoPrefix := fmt.Sprintf("CONN %s #%d", p.proxyKind, p.connId)
 	if p.secure {
 		connInfoPrefix = fmt.Sprintf("CONN %s (TLS) #%d", p.proxyKind, p.connId)
 	}
+	if p.logPrefix != "" {
+		connInfoPrefix = fmt.Sprintf("%s %s", p.logPrefix, connInfoPrefix)
+	}
+	if len(p.labels) > 0 {
+		connInfoPrefix = fmt.Sprintf("%s {%s}", connInfoPrefix, labelKey(p.labels))
+	}
 	p.connectionInfoPrefix = connInfoPrefix
 }
 
 func (p *Proxy) Start() {
+	defer close(p.done)
+	atomic.StoreInt32(&p.running, 1)
+	p.started = time.Now()
+	if p.registry != nil {
+		p.registry.Register(p)
+		defer p.registry.Deregister(p)
+	}
+	if len(p.labels) > 0 {
+		counters := labelCountersFor(p.labels)
+		counters.open()
+		defer counters.close(p)
+	}
 	defer tcp.CloseConnection(p.lConn)
+	p.applyLinger(p.lConn)
+	if p.capture != nil {
+		defer p.capture.close()
+	}
+
+	if p.sniffer != nil {
+		err := p.sniffProtocol()
+		if err != nil {
+			p.event("sniff_error", err, "cannot sniff protocol '%s'", err)
+			return
+		}
+	}
+	if p.serverProxyMode && p.handshakeTimeout > 0 {
+		p.lConn.SetReadDeadline(p.started.Add(p.handshakeTimeout))
+	}
+	if len(p.sniRoutes) > 0 && !p.passthrough {
+		err := p.routeSNI()
+		if err != nil {
+			p.event("sni_error", err, "cannot route by SNI '%s'", err)
+			return
+		}
+	}
+
+	if p.passthrough {
+		// forwarded untouched, none of the tunnel handshakes or rewrites apply
+		p.lInitialized = true
+		p.rInitialized = true
+		p.lWritten = true
+	}
+	if p.serverProxyMode && p.bidirectional {
+		// no upgrade request to answer, the reverse direction starts with the forward one
+		p.lInitialized = true
+		p.rInitialized = true
+	}
+
+	if p.proxyKind == "ss" && p.serverProxyMode && !p.passthrough {
+		err := p.ssServerHandshake()
+		if err != nil {
+			p.event("handshake_error", err, "cannot read shadowsocks request '%s'", err)
+			return
+		}
+	}
+	if p.proxyKind == "udp-over-tcp" && p.serverProxyMode && !p.passthrough {
+		p.frameDatagrams()
+	}
+	if p.lInitialized {
+		p.clearHandshakeDeadline()
+	}
+
+	if p.allowedDestinations != nil && p.remoteConn == nil && !p.destinationAllowed() {
+		p.rejectDestination()
+		return
+	}
+
+	releaseHandshake := p.acquireHandshake()
+	if releaseHandshake == nil {
+		return
+	}
+	defer releaseHandshake()
 
 	var err error
-	if p.tlsEnabled {
-		p.rConn, err = tls.Dial("tcp", p.rAddr.String(), &tls.Config{
-			ServerName:         p.sniHost,
-			InsecureSkipVerify: true,
-		})
+	if p.remoteConn != nil {
+		p.rConn = p.remoteConn
+		p.applyLinger(p.rConn)
 	} else {
-		p.rConn, err = net.DialTCP("tcp", nil, p.rAddr)
+		p.rConn, err = p.dialRemote()
+		if p.onDial != nil {
+			p.onDial(err)
+		}
+	}
+	var tlsErr *tlsHandshakeError
+	if errors.As(err, &tlsErr) {
+		p.event("tls_error", err, "cannot complete TLS handshake with remote, %s '%s'", tlsErr.reason, tlsErr.err)
+		return
 	}
 	if err != nil {
-		fmt.Printf("%s cannot dial remote connection '%s'\n", p.connectionInfoPrefix, err)
+		p.event("dial_error", err, "cannot dial remote connection '%s'", err)
 		return
 	}
-	defer tcp.CloseConnection(p.rConn)
+	defer func() {
+		tcp.CloseConnection(p.rConn)
+	}()
 
-	fmt.Printf("%s opened %s >> %s\n", p.connectionInfoPrefix, p.lAddr, p.rAddr)
+	if p.proxyKind == "ws" && !p.serverProxyMode && !p.passthrough {
+		wsConn, err := tcp.WSClientHandshake(p.rConn, p.wsHandshakeHost(), p.wsPath)
+		if err != nil {
+			p.event("handshake_error", err, "cannot perform websocket handshake '%s'", err)
+			return
+		}
+		p.rConn = wsConn
+		// upstream answers with websocket frames only, there is no response to rewrite
+		p.rInitialized = true
+	}
+	if p.proxyKind == "h2-connect" && !p.serverProxyMode && !p.passthrough {
+		if protocol, ok := negotiatedProtocol(p.rConn); ok && protocol != "h2" {
+			p.event("handshake_error", nil, "upstream did not negotiate h2 via ALPN")
+			return
+		}
+		h2Conn, err := tcp.H2Connect(p.rConn, p.h2ConnectAuthority(), "", "")
+		if err != nil {
+			p.event("handshake_error", err, "cannot open http2 CONNECT stream '%s'", err)
+			return
+		}
+		p.rConn = h2Conn
+		p.rInitialized = true
+	}
+	if p.proxyKind == "ss" && !p.serverProxyMode && !p.passthrough {
+		err = p.ssClientHandshake()
+		if err != nil {
+			p.event("handshake_error", err, "cannot send shadowsocks request '%s'", err)
+			return
+		}
+	}
+	if p.proxyKind == "udp-over-tcp" && !p.serverProxyMode && !p.passthrough {
+		p.frameDatagrams()
+	}
+	if p.proxyKind == "trojan" && p.trojanPassword != "" && !p.serverProxyMode && !p.passthrough {
+		err = p.writeTrojanRequest()
+		if err != nil {
+			p.event("handshake_error", err, "cannot send trojan request '%s'", err)
+			return
+		}
+		// the client stream is forwarded as is after the request, there is no path to rewrite or response to wait for
+		p.lInitialized = true
+		p.rInitialized = true
+	}
+	if len(p.payloadSequence) > 0 && !p.passthrough {
+		err = p.runPayloadSequence()
+		if err != nil {
+			p.event("handshake_error", err, "payload sequence failed '%s'", err)
+			return
+		}
+	}
 
-	go p.handleForwardData(p.lConn, p.rConn)
-	if !p.serverProxyMode {
-		go p.handleForwardData(p.rConn, p.lConn)
+	rHost := p.rHost
+	if rHost == "" {
+		rHost = p.rAddr.String()
+	}
+	releaseHandshake()
+	atomic.StoreInt64(&p.dialLatency, int64(time.Since(p.started)))
+	p.event("opened", nil, "opened %s >> %s (%s)", p.lAddr, rHost, p.rConn.RemoteAddr())
+
+	if p.openGracePeriod > 0 {
+		graceTimer := time.AfterFunc(p.openGracePeriod, func() {
+			if atomic.LoadUint64(&p.bytesSent) == 0 && atomic.LoadUint64(&p.bytesReceived) == 0 {
+				p.event("idle", nil, "no data within %s, closing", p.openGracePeriod)
+				p.Close()
+			}
+		})
+		defer graceTimer.Stop()
+	}
+	if p.statsInterval > 0 {
+		go p.logStats()
+	}
+	if p.maxConnDuration > 0 {
+		durationTimer := time.AfterFunc(p.maxConnDuration, func() {
+			p.event("max_duration", nil, "connection reached max duration %s, closing", p.maxConnDuration)
+			p.Close()
+		})
+		defer durationTimer.Stop()
+	}
+
+	atomic.AddInt32(&p.activeDirs, 1)
+	p.forward(p.lConn, p.rConn)
+	if p.serverProxyMode && !p.rInitialized {
+		// reverse direction starts once the upgrade response is fully written, passthrough, ss and bidirectional have no upgrade
+		p.forwarders.Add(1)
+		go func() {
+			defer p.forwarders.Done()
+			select {
+			case <-p.upgradeSig:
+				p.handleForwardData(p.rConn, p.lConn)
+			case <-p.errSig:
+			}
+		}()
+	} else {
+		atomic.AddInt32(&p.activeDirs, 1)
+		p.forward(p.rConn, p.lConn)
 	}
 	<-p.errSig
-	fmt.Printf("%s closed (%d bytes sent, %d bytes received)\n", p.connectionInfoPrefix, p.bytesSent, p.bytesReceived)
+	// unblock forwarders still reading or writing, the connections are closed once every forwarder exited
+	p.lConn.SetDeadline(time.Now())
+	p.rConnMu.Lock()
+	p.rConn.SetDeadline(time.Now())
+	p.rConnMu.Unlock()
+	p.forwarders.Wait()
+	info := p.Info()
+	p.event("closed", nil, "closed (%d bytes sent, %d bytes received, dial %s, first byte sent %s, received %s)",
+		info.BytesSent, info.BytesReceived, info.DialLatency, info.FirstByteSentLatency, info.FirstByteReceivedLatency)
+	if p.onClose != nil {
+		p.onClose(info)
+	}
+}
+
+func (p *Proxy) wsHandshakeHost() string {
+	if p.sHost.HostName != "" {
+		return p.sHost.HostName
+	}
+	if p.sniHost != "" {
+		return p.sniHost
+	}
+	return p.rAddr.String()
+}
+
+// h2ConnectAuthority is the CONNECT target of h2-connect, the server host or the remote address when none is set
+func (p *Proxy) h2ConnectAuthority() string {
+	if p.sHost.HostName != "" {
+		return net.JoinHostPort(p.sHost.HostName, strconv.FormatUint(p.sHost.Port, 10))
+	}
+	return p.rAddr.String()
+}
+
+func (p *Proxy) Info() ConnInfo {
+	return ConnInfo{
+		Id:            p.connId,
+		Local:         p.lAddr.String(),
+		Remote:        p.rAddr.String(),
+		Client:        p.lConn.RemoteAddr().String(),
+		BytesSent:     atomic.LoadUint64(&p.bytesSent),
+		BytesReceived: atomic.LoadUint64(&p.bytesReceived),
+		Started:       p.started,
+		Age:           time.Since(p.started),
+
+		DialLatency:              time.Duration(atomic.LoadInt64(&p.dialLatency)),
+		FirstByteSentLatency:     time.Duration(atomic.LoadInt64(&p.firstSentLatency)),
+		FirstByteReceivedLatency: time.Duration(atomic.LoadInt64(&p.firstReceivedLatency)),
+		LastActivity:             p.LastActivity(),
+		Labels:                   p.Labels(),
+	}
+}
+
+// LastActivity returns when bytes were last forwarded in either direction, the start time until the first forward
+func (p *Proxy) LastActivity() time.Time {
+	lastActivity := atomic.LoadInt64(&p.lastActivity)
+	if lastActivity == 0 {
+		return p.started
+	}
+	return time.Unix(0, lastActivity)
+}
+
+func (p *Proxy) event(name string, err error, format string, v ...interface{}) {
+	level := LevelInfo
+	if err != nil {
+		level = LevelError
+	}
+	p.logAt(level, name, err, format, v...)
+}
+
+func (p *Proxy) logAt(level, name string, err error, format string, v ...interface{}) {
+	e := &Event{
+		Level:         level,
+		ConnId:        p.connId,
+		Event:         name,
+		Local:         p.lAddr.String(),
+		Remote:        p.rAddr.String(),
+		BytesSent:     atomic.LoadUint64(&p.bytesSent),
+		BytesReceived: atomic.LoadUint64(&p.bytesReceived),
+		ProxyKind:     p.proxyKind,
+		TLS:           p.tlsEnabled,
+		Labels:        p.labels,
+		Timestamp:     time.Now(),
+		Message:       fmt.Sprintf("%s %s", p.connectionInfoPrefix, fmt.Sprintf(format, v...)),
+	}
+	e.DialLatency = time.Duration(atomic.LoadInt64(&p.dialLatency))
+	e.FirstByteSentLatency = time.Duration(atomic.LoadInt64(&p.firstSentLatency))
+	e.FirstByteReceivedLatency = time.Duration(atomic.LoadInt64(&p.firstReceivedLatency))
+	if err != nil {
+		e.Error = err.Error()
+	}
+	p.logger.Event(e)
+}
+
+func (p *Proxy) dialRemote() (net.Conn, error) {
+	var fwMarkControl tcp.ControlFunc
+	if p.fwMark > 0 {
+		fwMarkControl = tcp.ControlFwMark(p.fwMark)
+	}
+	localAddr := p.dialSourceAddr
+	var transparentControl tcp.ControlFunc
+	if p.tproxy {
+		if clientAddr, ok := p.lConn.RemoteAddr().(*net.TCPAddr); ok {
+			localAddr = &net.TCPAddr{IP: clientAddr.IP, Zone: clientAddr.Zone}
+		}
+		transparentControl = tcp.ControlTransparent()
+	}
+	network := p.dialNetwork
+	if p.dialsUDP() {
+		network, localAddr = udpDialArgs(network, localAddr)
+	}
+	dialer := &net.Dialer{
+		Timeout:   p.dialTimeout,
+		LocalAddr: localAddr,
+		Control:   tcp.ChainControl(fwMarkControl, transparentControl),
+	}
+	conn, err := dialer.Dial(network, p.rAddr.String())
+	if err != nil {
+		return nil, err
+	}
+	p.applyLinger(conn)
+	if !p.tlsEnabled || p.passthrough || p.dialsUDP() {
+		return conn, nil
+	}
+
+	serverName := p.sniHost
+	if p.frontDomain != "" {
+		serverName = p.frontDomain
+	}
+	tlsConfig := &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: true,
+	}
+	if p.proxyKind == "h2-connect" {
+		tlsConfig.NextProtos = []string{"h2"}
+	}
+	var rawConn net.Conn = conn
+	if p.tlsFragment {
+		rawConn = &fragmentConn{Conn: conn}
+	}
+	if p.tlsFingerprint != "" {
+		// the profile brings its own ALPN, h2 is only kept for h2-connect
+		uConn, err := p.uTLSClient(rawConn, serverName)
+		if err != nil {
+			tcp.CloseConnection(conn)
+			return nil, classifyTLSError(err, serverName)
+		}
+		return uConn, nil
+	}
+	tlsConn := tls.Client(rawConn, tlsConfig)
+	err = tlsConn.Handshake()
+	if err != nil {
+		tcp.CloseConnection(conn)
+		return nil, classifyTLSError(err, serverName)
+	}
+	return tlsConn, nil
 }
 
 func (p *Proxy) err() {
-	if p.erred {
+	p.errOnce.Do(func() {
+		close(p.errSig)
+	})
+}
+
+// errors raised while the connection is being torn down are expected
+func (p *Proxy) forwardErrLevel() string {
+	select {
+	case <-p.errSig:
+		return LevelDebug
+	default:
+		return LevelWarn
+	}
+}
+
+// swapRemote replaces the remote connection while forwarding, a conn swapped in after Start began closing gets its
+// deadline here instead
+func (p *Proxy) swapRemote(conn net.Conn) {
+	p.rConnMu.Lock()
+	defer p.rConnMu.Unlock()
+	tcp.CloseConnection(p.rConn)
+	p.rConn = conn
+	select {
+	case <-p.errSig:
+		conn.SetDeadline(time.Now())
+	default:
+	}
+}
+
+// openReverse starts server mode remote to local forwarding
+func (p *Proxy) openReverse() {
+	atomic.AddInt32(&p.activeDirs, 1)
+	close(p.upgradeSig)
+}
+
+// closeWrite propagates a half-close to dst while the other direction keeps running,
+// the connection is fully closed when both directions are done or dst is not a TCP conn
+func (p *Proxy) closeWrite(dst net.Conn) {
+	if atomic.AddInt32(&p.activeDirs, -1) <= 0 {
+		p.err()
 		return
 	}
-	p.errSig <- true
-	p.erred = true
+	tcpConn, ok := dst.(*net.TCPConn)
+	if !ok || tcpConn.CloseWrite() != nil {
+		p.err()
+	}
+}
+
+func (p *Proxy) Close() {
+	p.err()
+}
+
+// Done is closed when Start returns, every forwarder exited and both connections are closed
+func (p *Proxy) Done() <-chan struct{} {
+	return p.done
+}
+
+// forward runs handleForwardData in a goroutine Start waits for before it returns
+func (p *Proxy) forward(src, dst net.Conn) {
+	p.forwarders.Add(1)
+	go func() {
+		defer p.forwarders.Done()
+		p.handleForwardData(src, dst)
+	}()
 }
 
 func (p *Proxy) handleForwardData(src, dst net.Conn) {
+	atomic.AddInt64(&activeForwarders, 1)
+	defer atomic.AddInt64(&activeForwarders, -1)
 	isLocal := src == p.lConn
-	buffer := make([]byte, p.buffSize)
+	side, peerSide := "remote", "local"
+	if isLocal {
+		side, peerSide = "local", "remote"
+	}
+	buffer := make([]byte, atomic.LoadUint64(&p.buffSize))
 
 	for {
-		n, err := src.Read(buffer)
+		if buffSize := atomic.LoadUint64(&p.buffSize); buffSize != uint64(len(buffer)) {
+			buffer = make([]byte, buffSize)
+		}
+		var n int
+		var err error
+		if !isLocal && len(p.rPending) > 0 {
+			// remote bytes the payload sequence read past its last pattern
+			n = copy(buffer, p.rPending)
+			p.rPending = p.rPending[n:]
+		} else {
+			n, err = src.Read(buffer)
+		}
+		if err == io.EOF {
+			p.logAt(LevelDebug, "eof", nil, "%s side closed", side)
+			p.closeWrite(dst)
+			return
+		}
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() && isLocal && !p.lInitialized &&
+			p.handshakeTimeout > 0 && time.Since(p.started) >= p.handshakeTimeout {
+			p.event("handshake_timeout", nil, "no handshake within %s, closing", p.handshakeTimeout)
+			p.err()
+			return
+		}
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() && (isLocal && len(p.lBuff) > 0 || !isLocal && len(p.rBuff) > 0) {
+			// the head did not complete in time, what arrived is handled as it is
+			if isLocal {
+				p.lHeadExpired = true
+			} else {
+				p.rHeadExpired = true
+			}
+			n, err = 0, nil
+		}
 		if err != nil {
-			//fmt.Printf("Cannot read buffer from source '%s'\n", err)
+			p.logAt(p.forwardErrLevel(), "read_error", err, "cannot read from %s side '%s'", side, err)
 			p.err()
 			return
 		}
 		connBuff := buffer[:n]
+		if p.capture != nil && n > 0 {
+			direction := DirectionInbound
+			if isLocal {
+				direction = DirectionOutbound
+			}
+			err = p.capture.write(direction, connBuff)
+			if err != nil {
+				p.event("capture_error", err, "cannot write capture '%s'", err)
+			}
+		}
 		if isLocal {
-			p.handleOutboundData(src, dst, &connBuff)
+			err = p.handleOutboundData(src, dst, &connBuff)
+			if err != nil {
+				p.err()
+				return
+			}
+			// remote may have been swapped to the decoy backend
+			dst = p.rConn
 		} else {
-			p.handleInboundData(src, dst, &connBuff)
+			err = p.handleInboundData(src, dst, &connBuff)
+			if err != nil {
+				p.err()
+				return
+			}
+		}
+		if len(connBuff) == 0 {
+			continue
 		}
-		if p.serverProxyMode && p.wsUpgradeInitialized {
+		upgrade := p.serverProxyMode && p.wsUpgradeInitialized
+		if isLocal && !p.lWritten && !upgrade && p.outboundRegex != nil {
+			connBuff = p.outboundRegex.ReplaceAll(connBuff, p.outboundReplacement)
+		}
+		if p.streamInspector != nil && !upgrade {
+			direction := DirectionInbound
+			if isLocal {
+				direction = DirectionOutbound
+			}
+			connBuff = p.streamInspector(direction, connBuff)
+			if len(connBuff) == 0 {
+				continue
+			}
+		}
+		if upgrade {
+			p.setWriteDeadline(src)
 			n, err = src.Write(connBuff)
 			p.wsUpgradeInitialized = false
-			go p.handleForwardData(dst, src)
+			if err == nil && p.psk != nil {
+				err = p.pskChallenge(src)
+				if err != nil {
+					p.event("auth_error", err, "psk challenge failed '%s'", err)
+				}
+			}
+			if err == nil {
+				p.openReverse()
+			}
+		} else if isLocal && !p.lWritten {
+			p.setWriteDeadline(dst)
+			n, err = p.writeSplit(dst, connBuff)
+			p.lWritten = true
+			if err == nil && p.replayFirstWrite {
+				p.recordHandshake(connBuff)
+			}
 		} else {
+			p.setWriteDeadline(dst)
 			n, err = dst.Write(connBuff)
 		}
 		if err != nil {
-			//fmt.Printf("Cannot write buffer to destination '%s'\n", err)
+			p.logAt(p.forwardErrLevel(), "write_error", err, "cannot write to %s side '%s'", peerSide, err)
 			p.err()
 			return
 		}
 
+		atomic.StoreInt64(&p.lastActivity, time.Now().UnixNano())
+		// the first write of each direction is when the counter equals n
 		if isLocal {
-			p.bytesSent += uint64(n)
+			if atomic.AddUint64(&p.bytesSent, uint64(n)) == uint64(n) && n > 0 {
+				atomic.StoreInt64(&p.firstSentLatency, int64(time.Since(p.started)))
+			}
 		} else {
-			p.bytesReceived += uint64(n)
+			if atomic.AddUint64(&p.bytesReceived, uint64(n)) == uint64(n) && n > 0 {
+				atomic.StoreInt64(&p.firstReceivedLatency, int64(time.Since(p.started)))
+			}
+		}
+	}
+}
+
+func (p *Proxy) setWriteDeadline(conn net.Conn) {
+	if p.writeTimeout > 0 {
+		conn.SetWriteDeadline(time.Now().Add(p.writeTimeout))
+	}
+}
+
+func (p *Proxy) writeSplit(dst net.Conn, b []byte) (int, error) {
+	if p.splitSize <= 0 {
+		return dst.Write(b)
+	}
+	written := 0
+	for written < len(b) {
+		end := written + p.splitSize
+		if end > len(b) {
+			end = len(b)
+		}
+		if written > 0 {
+			time.Sleep(p.splitDelay)
+		}
+		n, err := dst.Write(b[written:end])
+		written += n
+		if err != nil {
+			return written, err
 		}
 	}
+	return written, nil
 }
 
-func (p *Proxy) handleOutboundData(src, dst net.Conn, connBuff *[]byte) {
+func (p *Proxy) handleOutboundData(src, dst net.Conn, connBuff *[]byte) error {
 	if p.lInitialized {
-		return
+		return nil
+	}
+
+	// server mode classifies the whole request head, it may be split across reads. The handshake timeout bounds
+	// the wait when set, headTimeout otherwise
+	if p.serverProxyMode {
+		buffering := len(p.lBuff) > 0
+		p.lBuff = append(p.lBuff, *connBuff...)
+		if p.outboundHeadPending() {
+			if !buffering && p.handshakeTimeout <= 0 {
+				p.setHeadDeadline(src, time.Now().Add(headTimeout))
+			}
+			*connBuff = (*connBuff)[:0]
+			return nil
+		}
+		if buffering && p.handshakeTimeout <= 0 {
+			p.setHeadDeadline(src, time.Time{})
+		}
+		*connBuff = p.lBuff
+		p.lBuff = nil
 	}
 
-	fmt.Printf("%s %s >> %s >> %s\n", p.connectionInfoPrefix, src.RemoteAddr(), p.conn.LocalAddr(), dst.RemoteAddr())
+	p.event("outbound", nil, "%s >> %s >> %s", src.RemoteAddr(), p.conn.LocalAddr(), dst.RemoteAddr())
 
 	var respArr []string
 	doUpgrade := false
@@ -210,51 +1205,201 @@ func (p *Proxy) handleOutboundData(src, dst net.Conn, connBuff *[]byte) {
 	}
 
 	if p.serverProxyMode {
+		if doUpgrade && !p.authorized(respArr) {
+			p.event("auth_error", nil, "missing or invalid %s header", p.authHeader)
+			src.Write([]byte("HTTP/1.1 403 Forbidden\r\nConnection: close\r\n\r\n"))
+			return errHandshakeClosed
+		}
 		if doUpgrade {
-			fmt.Printf("%s connection upgrade to Websocket\n", p.connectionInfoPrefix)
+			p.event("upgrade", nil, "connection upgrade to Websocket")
 			*connBuff = []byte("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
 			p.wsUpgradeInitialized = true
+			p.countRewrite(&rewriteStats.WSUpgrade, "ws upgrade")
+		} else if p.decoyBackend != "" {
+			timeout := p.dialTimeout
+			if timeout <= 0 {
+				timeout = decoyDialTimeout
+			}
+			decoyConn, err := net.DialTimeout("tcp", p.decoyBackend, timeout)
+			if err != nil {
+				p.event("decoy", err, "cannot dial decoy backend '%s'", err)
+				return errHandshakeClosed
+			}
+			p.event("decoy", nil, "not a websocket request, forwarding to decoy backend %s", p.decoyBackend)
+			p.swapRemote(decoyConn)
+			p.openReverse()
+		} else if p.decoyResponse != nil {
+			p.event("decoy", nil, "not a websocket request, sending decoy response")
+			src.Write(p.decoyResponse)
+			return errHandshakeClosed
 		}
 	} else {
-		if p.proxyKind == "ssh" && strings.Contains(respArr[0], "CONNECT ") {
-			*connBuff = p.lPayload
-			fmt.Println(string(*connBuff))
+		// the scanner yields nothing on empty input or a line longer than its token limit
+		requestLine := ""
+		if len(respArr) > 0 {
+			requestLine = respArr[0]
+		}
+		if (p.proxyKind == "ws" || p.proxyKind == "h2-connect") && strings.Contains(requestLine, "CONNECT ") {
+			// tunnel is already established on dial, answer locally
+			src.Write(p.rPayload)
+			*connBuff = (*connBuff)[:0]
+		}
+		if p.proxyKind == "ssh" && strings.Contains(requestLine, "CONNECT ") {
+			if p.replaceConnect {
+				*connBuff = p.connectPayload(requestLine, *connBuff)
+			} else {
+				*connBuff = p.rewriteConnectHost(*connBuff)
+			}
+			p.replayFirstWrite = true
+			p.countRewrite(&rewriteStats.Connect, "connect")
+			p.logger.Printf("%s\n", *connBuff)
 		}
 		if p.proxyKind == "trojan" {
-			reqPath := strings.Split(respArr[0], " ")[1]
-			newReqPath := fmt.Sprintf(" wss://%s%s ", p.sniHost, reqPath)
+			requestFields := strings.Split(requestLine, " ")
+			if len(requestFields) < 3 {
+				p.event("handshake_error", errMalformedRequest, "cannot rewrite trojan path '%s'", errMalformedRequest)
+				return errHandshakeClosed
+			}
+			reqPath := requestFields[1]
+			wsHost := p.wsHost
+			if wsHost == "" {
+				wsHost = p.sniHost
+			}
+			newReqPath := fmt.Sprintf(" wss://%s%s ", wsHost, reqPath)
 			*connBuff = []byte(strings.Replace(string(*connBuff), fmt.Sprintf(" %s ", reqPath), newReqPath, -1))
-			fmt.Println(string(*connBuff))
+			p.countRewrite(&rewriteStats.Trojan, "trojan path")
+			p.logger.Printf("%s\n", *connBuff)
 		}
 	}
 
 	p.lInitialized = true
+	p.clearHandshakeDeadline()
+	return nil
 }
 
-func (p *Proxy) handleInboundData(src, dst net.Conn, connBuff *[]byte) {
-	if p.rInitialized {
-		return
+func (p *Proxy) authorized(reqArr []string) bool {
+	if p.authToken == "" {
+		return true
 	}
+	for _, line := range reqArr {
+		kv := strings.SplitN(line, ":", 2)
+		if len(kv) == 2 && strings.EqualFold(strings.TrimSpace(kv[0]), p.authHeader) {
+			return subtle.ConstantTimeCompare([]byte(strings.TrimSpace(kv[1])), []byte(p.authToken)) == 1
+		}
+	}
+	return false
+}
 
-	fmt.Printf("%s %s << %s << %s\n", p.connectionInfoPrefix, dst.RemoteAddr(), p.conn.LocalAddr(), src.RemoteAddr())
-
-	var respArr []string
-	buffScanner := bufio.NewScanner(strings.NewReader(string(*connBuff)))
-	for buffScanner.Scan() {
-		respArr = append(respArr, buffScanner.Text())
+func (p *Proxy) handleInboundData(src, dst net.Conn, connBuff *[]byte) error {
+	if p.rInitialized {
+		return nil
 	}
-	if strings.Contains(respArr[0], " 101 ") && p.proxyKind == "ssh" {
-		respArr[0] = strings.Replace(string(p.rPayload), "\r\n", "", -1)
+
+	// hold the response head when the status line may be rewritten or a psk challenge follows, it may be split
+	// across reads. Anything else is forwarded as read
+	if !p.serverProxyMode && (p.rewriteInbound && p.proxyKind == "ssh" || p.psk != nil) {
+		buffering := len(p.rBuff) > 0
+		p.rBuff = append(p.rBuff, *connBuff...)
+		if p.inboundHeadPending() {
+			if !buffering {
+				p.setHeadDeadline(src, time.Now().Add(p.headTimeout()))
+			}
+			*connBuff = (*connBuff)[:0]
+			return nil
+		}
+		if buffering {
+			p.setHeadDeadline(src, time.Time{})
+		}
+		headerEnd := bytes.Index(p.rBuff, []byte("\r\n\r\n"))
+		// a psk challenge follows the upgrade response
+		awaitChallenge := p.psk != nil && headerEnd >= 0 && bytes.Contains(p.rBuff[:headerEnd], []byte(" 101 "))
+		if awaitChallenge && len(p.rBuff) >= headerEnd+4+pskChallengeSize {
+			challengeEnd := headerEnd + 4 + pskChallengeSize
+			err := p.pskRespond(src, p.rBuff[headerEnd+4:challengeEnd])
+			if err != nil {
+				p.event("auth_error", err, "cannot answer psk challenge '%s'", err)
+				return err
+			}
+			p.rBuff = append(p.rBuff[:headerEnd+4], p.rBuff[challengeEnd:]...)
+		}
+		*connBuff = p.rBuff
+		p.rBuff = nil
 	}
-	// TODO handle redirect 301 / 302
-	//if strings.Contains(respArr[0], " 301 ") || strings.Contains(respArr[0], "302") {
-	//	respArr[0] = "HTTP/1.1 101 Switching Protocols"
-	//}
+
+	p.event("inbound", nil, "%s << %s << %s", dst.RemoteAddr(), p.conn.LocalAddr(), src.RemoteAddr())
 
 	if !p.serverProxyMode {
-		*connBuff = []byte(strings.Join(respArr, "\r\n") + "\r\n")
-		fmt.Println(string(*connBuff))
+		// only the status line is rewritten, remaining bytes are forwarded untouched
+		statusLine, rest := *connBuff, []byte(nil)
+		if i := bytes.IndexByte(*connBuff, '\n'); i >= 0 {
+			statusLine, rest = (*connBuff)[:i], (*connBuff)[i+1:]
+		}
+		if p.rewriteInbound && bytes.Contains(statusLine, []byte(" 101 ")) && p.proxyKind == "ssh" {
+			status := bytes.TrimRight(p.rPayload, "\r\n")
+			newBuff := make([]byte, 0, len(status)+2+len(rest))
+			newBuff = append(newBuff, status...)
+			newBuff = append(newBuff, "\r\n"...)
+			*connBuff = append(newBuff, rest...)
+			p.countRewrite(&rewriteStats.Inbound, "inbound 101")
+		}
+		// TODO handle redirect 301 / 302
+		p.logger.Printf("%s\n", *connBuff)
 	}
 
 	p.rInitialized = true
+	return nil
+}
+
+// outboundHeadPending reports whether the buffered request head is incomplete, requests that do not start with an
+// HTTP method are not held back
+func (p *Proxy) outboundHeadPending() bool {
+	if p.lHeadExpired || uint64(len(p.lBuff)) >= atomic.LoadUint64(&p.buffSize) {
+		return false
+	}
+	for i, c := range p.lBuff {
+		if c == ' ' && i > 0 {
+			break
+		}
+		if c < 'A' || c > 'Z' {
+			return false
+		}
+	}
+	return !bytes.Contains(p.lBuff, []byte("\r\n\r\n"))
+}
+
+// inboundHeadPending reports whether more of the buffered response is needed, the status line for the rewrite or the
+// headers and challenge when a psk challenge follows. Responses that do not start like HTTP are not held back
+func (p *Proxy) inboundHeadPending() bool {
+	if p.rHeadExpired || uint64(len(p.rBuff)) >= atomic.LoadUint64(&p.buffSize) {
+		return false
+	}
+	if !bytes.HasPrefix(p.rBuff, []byte("HTTP/")) && !bytes.HasPrefix([]byte("HTTP/"), p.rBuff) {
+		return false
+	}
+	if p.psk == nil {
+		return bytes.IndexByte(p.rBuff, '\n') < 0
+	}
+	headerEnd := bytes.Index(p.rBuff, []byte("\r\n\r\n"))
+	if headerEnd < 0 {
+		return true
+	}
+	return bytes.Contains(p.rBuff[:headerEnd], []byte(" 101 ")) && len(p.rBuff) < headerEnd+4+pskChallengeSize
+}
+
+func (p *Proxy) headTimeout() time.Duration {
+	if p.handshakeTimeout > 0 {
+		return p.handshakeTimeout
+	}
+	return headTimeout
+}
+
+// setHeadDeadline sets the read deadline of a buffered head, a zero t lifts it. A proxy already closing keeps conn
+// expired so the forwarder still exits
+func (p *Proxy) setHeadDeadline(conn net.Conn, t time.Time) {
+	conn.SetReadDeadline(t)
+	select {
+	case <-p.errSig:
+		conn.SetReadDeadline(time.Now())
+	default:
+	}
 }
@@ -0,0 +1,161 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+var benchBufferSizes = []uint64{4 << 10, 16 << 10, 0xffff}
+
+func BenchmarkForward(b *testing.B) {
+	for _, buffSize := range benchBufferSizes {
+		b.Run(fmt.Sprintf("large/buff=%d", buffSize), func(b *testing.B) {
+			benchmarkLargeTransfer(b, buffSize)
+		})
+		b.Run(fmt.Sprintf("small/buff=%d", buffSize), func(b *testing.B) {
+			benchmarkSmallConnections(b, buffSize)
+		})
+		b.Run(fmt.Sprintf("pipe/buff=%d", buffSize), func(b *testing.B) {
+			benchmarkPipeTransfer(b, buffSize)
+		})
+	}
+}
+
+// benchmarkLargeTransfer sends b.N chunks through one connection to a remote discarding them
+func benchmarkLargeTransfer(b *testing.B, buffSize uint64) {
+	received := make(chan int64, 1)
+	remote := serveLoopback(b, func(conn net.Conn) {
+		n, _ := io.Copy(ioutil.Discard, conn)
+		received <- n
+	})
+	defer remote.Close()
+	local := serveLoopback(b, nil)
+	defer local.Close()
+
+	chunk := make([]byte, 32<<10)
+	client, _ := loopbackProxy(b, local, remote, buffSize)
+	defer client.Close()
+	b.SetBytes(int64(len(chunk)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := client.Write(chunk)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	client.(*net.TCPConn).CloseWrite()
+	n := <-received
+	b.StopTimer()
+	if n != int64(b.N*len(chunk)) {
+		b.Fatalf("remote received %d bytes, want %d", n, b.N*len(chunk))
+	}
+}
+
+// benchmarkPipeTransfer is the large transfer over net.Pipe, it measures the forwarding loop without the copies of
+// the loopback sockets
+func benchmarkPipeTransfer(b *testing.B, buffSize uint64) {
+	client, lConn := net.Pipe()
+	rConn, remote := net.Pipe()
+	p := New(lConn, nil, nil, WithLogger(NewJSONLogger(ioutil.Discard)), WithBufferSize(buffSize))
+	p.SetRemoteConn(rConn)
+	p.SetRewriteInbound(false)
+	go p.Start()
+	received := make(chan int64, 1)
+	go func() {
+		n, _ := io.Copy(ioutil.Discard, remote)
+		received <- n
+	}()
+
+	chunk := make([]byte, 32<<10)
+	b.SetBytes(int64(len(chunk)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := client.Write(chunk)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	// pipes have no half close, the proxy closes the remote once the local side is gone
+	client.Close()
+	n := <-received
+	b.StopTimer()
+	<-p.Done()
+	if n != int64(b.N*len(chunk)) {
+		b.Fatalf("remote received %d bytes, want %d", n, b.N*len(chunk))
+	}
+}
+
+// benchmarkSmallConnections opens b.N connections that each exchange one message with an echo remote
+func benchmarkSmallConnections(b *testing.B, buffSize uint64) {
+	remote := serveLoopback(b, func(conn net.Conn) {
+		io.Copy(conn, conn)
+	})
+	defer remote.Close()
+	local := serveLoopback(b, nil)
+	defer local.Close()
+
+	message := make([]byte, 512)
+	reply := make([]byte, len(message))
+	b.SetBytes(int64(len(message)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		client, p := loopbackProxy(b, local, remote, buffSize)
+		_, err := client.Write(message)
+		if err == nil {
+			_, err = io.ReadFull(client, reply)
+		}
+		if err != nil {
+			b.Fatal(err)
+		}
+		client.Close()
+		<-p.Done()
+	}
+}
+
+// serveLoopback listens on loopback and runs handle on every accepted connection, a nil handle leaves accepting to
+// the caller
+func serveLoopback(b *testing.B, handle func(conn net.Conn)) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	if handle != nil {
+		go func() {
+			for {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				go func() {
+					defer conn.Close()
+					handle(conn)
+				}()
+			}
+		}()
+	}
+	return ln
+}
+
+// loopbackProxy dials local and starts a proxy forwarding the accepted connection to remote, it returns the client
+// end of the local connection
+func loopbackProxy(b *testing.B, local, remote net.Listener, buffSize uint64) (net.Conn, *Proxy) {
+	client, err := net.Dial("tcp", local.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	conn, err := local.Accept()
+	if err != nil {
+		b.Fatal(err)
+	}
+	p := New(conn, local.Addr().(*net.TCPAddr), remote.Addr().(*net.TCPAddr),
+		WithLogger(NewJSONLogger(ioutil.Discard)), WithBufferSize(buffSize))
+	p.SetRewriteInbound(false)
+	go p.Start()
+	return client, p
+}
@@ -0,0 +1,524 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"github.com/lutfailham96/go-tcp-proxy-tunnel/internal/tcp"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// pipeProxy starts a proxy between two pipes and returns the client end of the local side and the server end of
+// the remote side
+func pipeProxy(configure func(p *Proxy)) (local, remote net.Conn, p *Proxy) {
+	local, lConn := net.Pipe()
+	rConn, remote := net.Pipe()
+	p = New(lConn, nil, nil, WithLogger(NewJSONLogger(ioutil.Discard)))
+	p.SetRemoteConn(rConn)
+	if configure != nil {
+		configure(p)
+	}
+	go p.Start()
+	return local, remote, p
+}
+
+// readAll reads conn until it is closed, failing the test when that takes too long
+func readAll(t *testing.T, conn net.Conn) []byte {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	b, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("cannot read '%s'", err)
+	}
+	return b
+}
+
+func TestRewriteInboundDisabled(t *testing.T) {
+	local, remote, _ := pipeProxy(func(p *Proxy) {
+		p.SetRewriteInbound(false)
+	})
+	defer local.Close()
+	defer remote.Close()
+
+	// the status line is forwarded before the headers are complete
+	partial := []byte("HTTP/1.1 101 Switch")
+	_, err := remote.Write(partial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	local.SetReadDeadline(time.Now().Add(5 * time.Second))
+	got := make([]byte, len(partial))
+	_, err = io.ReadFull(local, got)
+	if err != nil {
+		t.Fatalf("partial response not forwarded '%s'", err)
+	}
+	if !bytes.Equal(got, partial) {
+		t.Fatalf("got %q, want %q", got, partial)
+	}
+
+	rest := []byte("ing Protocols\r\nUpgrade: websocket\r\n\r\nSSH-2.0-OpenSSH\r\n")
+	_, err = remote.Write(rest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote.Close()
+	if got := readAll(t, local); !bytes.Equal(got, rest) {
+		t.Fatalf("got %q, want %q", got, rest)
+	}
+}
+
+func TestInboundRewriteKeepsBinaryBody(t *testing.T) {
+	local, remote, _ := pipeProxy(nil)
+	defer local.Close()
+	defer remote.Close()
+
+	// every byte value, line breaks and a fake status line included
+	body := []byte("\r\n\nHTTP/1.1 101 \r\n\r\n")
+	for i := 0; i < 256; i++ {
+		body = append(body, byte(i))
+	}
+	response := append([]byte("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\n\r\n"), body...)
+	go func() {
+		remote.Write(response)
+		remote.Close()
+	}()
+
+	want := append([]byte("HTTP/1.1 200 Connection Established\r\nUpgrade: websocket\r\n\r\n"), body...)
+	if got := readAll(t, local); !bytes.Equal(got, want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func TestServerUpgradeOrdering(t *testing.T) {
+	request := []byte("GET / HTTP/1.1\r\nHost: example.com\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+	upgrade := []byte("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+	remoteStream := make([]byte, 1024)
+	localStream := make([]byte, 1024)
+	for i := range remoteStream {
+		remoteStream[i] = byte(i)
+		localStream[i] = byte(255 - i%256)
+	}
+
+	for _, offset := range []int{1, 2, 17, 512, 1023} {
+		local, remote, _ := pipeProxy(func(p *Proxy) {
+			p.SetServerProxyMode(true)
+		})
+
+		// the remote talks first, its bytes must follow the upgrade response
+		remoteErr := make(chan error, 1)
+		go func() {
+			defer remote.Close()
+			for _, chunk := range [][]byte{remoteStream[:offset], remoteStream[offset:]} {
+				_, err := remote.Write(chunk)
+				if err != nil {
+					remoteErr <- err
+					return
+				}
+			}
+			got := make([]byte, len(localStream))
+			remote.SetReadDeadline(time.Now().Add(5 * time.Second))
+			_, err := io.ReadFull(remote, got)
+			if err == nil && !bytes.Equal(got, localStream) {
+				err = fmt.Errorf("remote got %q, want %q", got, localStream)
+			}
+			remoteErr <- err
+		}()
+
+		received := make(chan []byte, 1)
+		go func() {
+			local.SetReadDeadline(time.Now().Add(5 * time.Second))
+			b, _ := ioutil.ReadAll(local)
+			received <- b
+		}()
+		for _, chunk := range [][]byte{request, localStream[:offset], localStream[offset:]} {
+			_, err := local.Write(chunk)
+			if err != nil {
+				t.Fatalf("offset %d: cannot write local '%s'", offset, err)
+			}
+		}
+
+		err := <-remoteErr
+		if err != nil {
+			t.Fatalf("offset %d: %s", offset, err)
+		}
+		want := append(append([]byte{}, upgrade...), remoteStream...)
+		if got := <-received; !bytes.Equal(got, want) {
+			t.Fatalf("offset %d: local got %q, want %q", offset, got, want)
+		}
+		local.Close()
+	}
+}
+
+func TestPayloadSetterOrder(t *testing.T) {
+	template := "CONNECT [host_port] HTTP/1.1[crlf]Host: [host][crlf]X-Online-Host: [sni][crlf][crlf]"
+	want := "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com\r\nX-Online-Host: sni.example.com\r\n\r\n"
+
+	payloadFirst := NewProxy(0, nil, nil, nil, false)
+	payloadFirst.SetlPayload(template)
+	payloadFirst.SetServerHost("example.com:443")
+	payloadFirst.SetSNIHost("sni.example.com")
+
+	hostsFirst := NewProxy(0, nil, nil, nil, false)
+	hostsFirst.SetSNIHost("sni.example.com")
+	hostsFirst.SetServerHost("example.com:443")
+	hostsFirst.SetlPayload(template)
+
+	for name, p := range map[string]*Proxy{"payload first": payloadFirst, "hosts first": hostsFirst} {
+		if got := string(p.lPayload); got != want {
+			t.Errorf("%s: got %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestForwardersExit(t *testing.T) {
+	request := []byte("GET / HTTP/1.1\r\nHost: example.com\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+	before := runtime.NumGoroutine()
+
+	for i := 0; i < 100; i++ {
+		local, remote, p := pipeProxy(func(p *Proxy) {
+			p.SetServerProxyMode(true)
+		})
+		local.SetDeadline(time.Now().Add(5 * time.Second))
+		_, err := local.Write(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		upgrade := make([]byte, 128)
+		_, err = local.Read(upgrade)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// both directions are forwarding, each side closes in turn
+		switch i % 3 {
+		case 0:
+			local.Close()
+		case 1:
+			remote.Close()
+		default:
+			p.Close()
+		}
+		select {
+		case <-p.Done():
+		case <-time.After(5 * time.Second):
+			t.Fatalf("connection %d did not close", i)
+		}
+		local.Close()
+		remote.Close()
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d goroutines left running, started with %d", runtime.NumGoroutine(), before)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestHandshakeReplay(t *testing.T) {
+	greeting := []byte("GET /tunnel HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	local, remote, p := pipeProxy(func(p *Proxy) {
+		p.SetlPayload("CONNECT [target] HTTP/1.1[crlf]Host: example.com[crlf][crlf]")
+		p.SetPayloadSequence([]PayloadStep{{Send: greeting}})
+		p.SetHandshakeReplayLimit(1 << 10)
+	})
+	defer local.Close()
+	defer remote.Close()
+
+	connect := []byte("CONNECT 10.0.0.1:22 HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	data := []byte("SSH-2.0-OpenSSH\r\n")
+	want := append(append([]byte{}, greeting...), connect...)
+	go func() {
+		local.Write([]byte("CONNECT 10.0.0.1:22 HTTP/1.1\r\n\r\n"))
+		local.Write(data)
+	}()
+	// forwarded data follows the handshake, it is not recorded
+	remote.SetReadDeadline(time.Now().Add(5 * time.Second))
+	got := make([]byte, len(want)+len(data))
+	_, err := io.ReadFull(remote, got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if handshake := p.HandshakeBytes(); !bytes.Equal(handshake, want) {
+		t.Fatalf("got handshake %q, want %q", handshake, want)
+	}
+
+	replayed, redialed := net.Pipe()
+	defer replayed.Close()
+	go func() {
+		p.ReplayHandshake(replayed)
+	}()
+	redialed.SetReadDeadline(time.Now().Add(5 * time.Second))
+	got = make([]byte, len(want))
+	_, err = io.ReadFull(redialed, got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("replayed %q, want %q", got, want)
+	}
+
+	capped := NewProxy(0, nil, nil, nil, false)
+	capped.SetHandshakeReplayLimit(len(greeting) - 1)
+	capped.recordHandshake(greeting)
+	if capped.HandshakeBytes() != nil || capped.ReplayHandshake(replayed) != errHandshakeNotRecorded {
+		t.Fatal("handshake over the replay limit was kept")
+	}
+
+	disabled := NewProxy(0, nil, nil, nil, false)
+	disabled.recordHandshake(greeting)
+	if disabled.HandshakeBytes() != nil || disabled.ReplayHandshake(replayed) != errHandshakeReplayOff {
+		t.Fatal("handshake recorded without a replay limit")
+	}
+}
+
+func TestInboundHeadNotHeld(t *testing.T) {
+	// a response that is not HTTP goes through at once, a stalled status line once the head deadline passes
+	for _, response := range [][]byte{[]byte("SSH-2.0-OpenSSH"), []byte("HTTP/1.1 10")} {
+		local, remote, _ := pipeProxy(func(p *Proxy) {
+			p.SetHandshakeTimeout(100 * time.Millisecond)
+		})
+		_, err := remote.Write(response)
+		if err != nil {
+			t.Fatal(err)
+		}
+		local.SetReadDeadline(time.Now().Add(5 * time.Second))
+		got := make([]byte, len(response))
+		_, err = io.ReadFull(local, got)
+		if err != nil {
+			t.Fatalf("%q not forwarded '%s'", response, err)
+		}
+		if !bytes.Equal(got, response) {
+			t.Fatalf("got %q, want %q", got, response)
+		}
+		local.Close()
+		remote.Close()
+	}
+}
+
+func TestServerSplitUpgradeRequest(t *testing.T) {
+	request := []byte("GET / HTTP/1.1\r\nHost: example.com\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+	upgrade := []byte("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+	for _, offset := range []int{1, 3, 20, 40, len(request) - 1} {
+		local, remote, _ := pipeProxy(func(p *Proxy) {
+			p.SetServerProxyMode(true)
+		})
+		local.SetDeadline(time.Now().Add(5 * time.Second))
+		for _, chunk := range [][]byte{request[:offset], request[offset:]} {
+			_, err := local.Write(chunk)
+			if err != nil {
+				t.Fatalf("offset %d: cannot write local '%s'", offset, err)
+			}
+		}
+		got := make([]byte, len(upgrade))
+		_, err := io.ReadFull(local, got)
+		if err != nil {
+			t.Fatalf("offset %d: no upgrade response '%s'", offset, err)
+		}
+		if !bytes.Equal(got, upgrade) {
+			t.Fatalf("offset %d: got %q, want %q", offset, got, upgrade)
+		}
+		local.Close()
+		remote.Close()
+	}
+}
+
+func TestServerSplitDecoyRequest(t *testing.T) {
+	decoy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer decoy.Close()
+	decoyRequests := make(chan []byte, 2)
+	go func() {
+		for {
+			conn, err := decoy.Accept()
+			if err != nil {
+				return
+			}
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			b := make([]byte, 1024)
+			n, _ := conn.Read(b)
+			decoyRequests <- b[:n]
+			conn.Write([]byte("HTTP/1.1 200 OK\r\n\r\n"))
+			conn.Close()
+		}
+	}()
+
+	upgradeRequest := []byte("GET / HTTP/1.1\r\nHost: example.com\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+	plainRequest := []byte("GET / HTTP/1.1\r\nHost: example.com\r\nAccept: */*\r\n\r\n")
+	for _, tc := range []struct {
+		request []byte
+		want    string
+	}{
+		{upgradeRequest, "HTTP/1.1 101 "},
+		{plainRequest, "HTTP/1.1 200 "},
+	} {
+		local, remote, _ := pipeProxy(func(p *Proxy) {
+			p.SetServerProxyMode(true)
+			p.SetDecoyBackend(decoy.Addr().String())
+		})
+		local.SetDeadline(time.Now().Add(5 * time.Second))
+		for _, chunk := range [][]byte{tc.request[:20], tc.request[20:]} {
+			_, err := local.Write(chunk)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		got := make([]byte, len(tc.want))
+		_, err := io.ReadFull(local, got)
+		if err != nil {
+			t.Fatalf("no response to %q '%s'", tc.request, err)
+		}
+		if string(got) != tc.want {
+			t.Fatalf("got %q, want %q", got, tc.want)
+		}
+		local.Close()
+		remote.Close()
+	}
+	if got := <-decoyRequests; !bytes.Equal(got, plainRequest) {
+		t.Fatalf("decoy got %q, want %q", got, plainRequest)
+	}
+	if len(decoyRequests) > 0 {
+		t.Fatal("upgrade request forwarded to the decoy backend")
+	}
+}
+
+func TestServerSplitAuthToken(t *testing.T) {
+	request := []byte("GET / HTTP/1.1\r\nHost: example.com\r\nUpgrade: websocket\r\nX-Auth-Token: token\r\n\r\n")
+	// the token header arrives after the upgrade header in a later read
+	split := bytes.Index(request, []byte("X-Auth"))
+	for _, tc := range []struct {
+		token string
+		want  string
+	}{
+		{"token", "HTTP/1.1 101 "},
+		{"other", "HTTP/1.1 403 "},
+	} {
+		local, remote, _ := pipeProxy(func(p *Proxy) {
+			p.SetServerProxyMode(true)
+			p.SetAuthToken("X-Auth-Token", tc.token)
+		})
+		local.SetDeadline(time.Now().Add(5 * time.Second))
+		for _, chunk := range [][]byte{request[:split], request[split:]} {
+			_, err := local.Write(chunk)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		got := make([]byte, len(tc.want))
+		_, err := io.ReadFull(local, got)
+		if err != nil {
+			t.Fatalf("no response with token %q '%s'", tc.token, err)
+		}
+		if string(got) != tc.want {
+			t.Fatalf("token %q: got %q, want %q", tc.token, got, tc.want)
+		}
+		local.Close()
+		remote.Close()
+	}
+}
+
+func TestFingerprintALPN(t *testing.T) {
+	ts := httptest.NewUnstartedServer(nil)
+	ts.TLS = &tls.Config{NextProtos: []string{"h2", "http/1.1"}}
+	ts.StartTLS()
+	defer ts.Close()
+
+	for kind, want := range map[string]string{"ws": "http/1.1", "h2-connect": "h2"} {
+		for profile := range tlsFingerprints {
+			if profile == "randomized" {
+				// the randomized ClientHello may leave out ALPN
+				continue
+			}
+			p := NewProxy(0, nil, nil, nil, false)
+			p.SetProxyKind(kind)
+			p.SetTLSFingerprint(profile)
+			conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			uConn, err := p.uTLSClient(conn, "example.com")
+			if err != nil {
+				t.Fatalf("%s %s: %s", kind, profile, err)
+			}
+			if got, _ := negotiatedProtocol(uConn); got != want {
+				t.Errorf("%s %s: negotiated %q, want %q", kind, profile, got, want)
+			}
+			conn.Close()
+		}
+	}
+}
+
+func TestPayloadSequenceLeftoverRewritten(t *testing.T) {
+	local, remote, _ := pipeProxy(func(p *Proxy) {
+		p.SetPayloadSequence([]PayloadStep{{Send: []byte("HELLO\r\n"), WaitFor: []byte("READY\r\n")}})
+	})
+	defer local.Close()
+	defer remote.Close()
+
+	remote.SetDeadline(time.Now().Add(5 * time.Second))
+	hello := make([]byte, len("HELLO\r\n"))
+	_, err := io.ReadFull(remote, hello)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the response after the awaited pattern arrives in the same read and takes the inbound path
+	go func() {
+		remote.Write([]byte("READY\r\nHTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\n\r\nbody"))
+		remote.Close()
+	}()
+
+	want := []byte("HTTP/1.1 200 Connection Established\r\nUpgrade: websocket\r\n\r\nbody")
+	if got := readAll(t, local); !bytes.Equal(got, want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func TestSSServerReplay(t *testing.T) {
+	key := SSPasswordKey("secret")
+	// record one client stream, the target address followed by a payload
+	recorder, w := net.Pipe()
+	go func() {
+		ssConn, _ := tcp.NewSSConn(w, key)
+		address, _ := socksAddress("example.com:443")
+		ssConn.Write(append(address, "hello"...))
+		w.Close()
+	}()
+	stream, err := ioutil.ReadAll(recorder)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the second time the same stream arrives it is refused
+	for i := 0; i < 2; i++ {
+		local, remote, _ := pipeProxy(func(p *Proxy) {
+			p.SetServerProxyMode(true)
+			p.SetProxyKind("ss")
+			p.SetSSKey(key)
+		})
+		go local.Write(stream)
+		if i == 0 {
+			remote.SetDeadline(time.Now().Add(5 * time.Second))
+			got := make([]byte, 5)
+			_, err = io.ReadFull(remote, got)
+			if err != nil || string(got) != "hello" {
+				t.Fatalf("remote got %q '%v', want %q", got, err, "hello")
+			}
+		} else {
+			local.SetDeadline(time.Now().Add(5 * time.Second))
+			_, err = local.Read(make([]byte, 1))
+			if err != io.EOF {
+				t.Fatalf("replayed stream not closed '%v'", err)
+			}
+		}
+		local.Close()
+		remote.Close()
+	}
+}
@@ -0,0 +1,80 @@
+package proxy
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+// Challenge-response between paired proxies, right after the server writes the upgrade response:
+//
+//	server -> client: challenge, 1 byte version (0x01) + 32 bytes random nonce
+//	client -> server: response, 32 bytes HMAC-SHA256(psk, nonce)
+//
+// The server closes the connection when the response does not match, forwarding starts afterwards.
+const (
+	pskVersion       = 0x01
+	pskNonceSize     = 32
+	pskChallengeSize = 1 + pskNonceSize
+	pskResponseSize  = sha256.Size
+
+	// pskResponseTimeout bounds the wait for the response when no handshake timeout is set
+	pskResponseTimeout = 10 * time.Second
+)
+
+var errPSKMismatch = errors.New("psk challenge response mismatch")
+
+func (p *Proxy) SetPSK(psk []byte) {
+	if p.startedWarn("SetPSK") {
+		return
+	}
+	p.psk = psk
+}
+
+func (p *Proxy) pskChallenge(conn net.Conn) error {
+	challenge := make([]byte, pskChallengeSize)
+	challenge[0] = pskVersion
+	_, err := rand.Read(challenge[1:])
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(challenge)
+	if err != nil {
+		return err
+	}
+
+	timeout := p.handshakeTimeout
+	if timeout <= 0 {
+		timeout = pskResponseTimeout
+	}
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	response := make([]byte, pskResponseSize)
+	_, err = io.ReadFull(conn, response)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(response, p.pskMAC(challenge[1:])) {
+		return errPSKMismatch
+	}
+	return nil
+}
+
+func (p *Proxy) pskRespond(conn net.Conn, challenge []byte) error {
+	if challenge[0] != pskVersion {
+		return errors.New("unsupported psk challenge version")
+	}
+	_, err := conn.Write(p.pskMAC(challenge[1:]))
+	return err
+}
+
+func (p *Proxy) pskMAC(nonce []byte) []byte {
+	mac := hmac.New(sha256.New, p.psk)
+	mac.Write(nonce)
+	return mac.Sum(nil)
+}
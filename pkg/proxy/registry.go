@@ -0,0 +1,77 @@
+package proxy
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+type ConnInfo struct {
+	Id            uint64        `json:"id"`
+	Local         string        `json:"local"`
+	Remote        string        `json:"remote"`
+	Client        string        `json:"client"`
+	BytesSent     uint64        `json:"bytes_sent"`
+	BytesReceived uint64        `json:"bytes_received"`
+	Started       time.Time     `json:"started"`
+	Age           time.Duration `json:"age"`
+
+	// time from Start to the remote being ready and to the first byte forwarded in each direction, 0 until reached
+	DialLatency              time.Duration     `json:"dial_latency"`
+	FirstByteSentLatency     time.Duration     `json:"first_byte_sent_latency"`
+	FirstByteReceivedLatency time.Duration     `json:"first_byte_received_latency"`
+	LastActivity             time.Time         `json:"last_activity"`
+	Labels                   map[string]string `json:"labels,omitempty"`
+}
+
+// Registry tracks live proxies, a proxy registers itself on Start when SetRegistry was called
+type Registry struct {
+	mu      sync.RWMutex
+	proxies map[uint64]*Proxy
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		proxies: make(map[uint64]*Proxy),
+	}
+}
+
+func (r *Registry) Register(p *Proxy) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.proxies[p.connId] = p
+}
+
+func (r *Registry) Deregister(p *Proxy) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.proxies[p.connId] == p {
+		delete(r.proxies, p.connId)
+	}
+}
+
+func (r *Registry) Get(connId uint64) *Proxy {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.proxies[connId]
+}
+
+func (r *Registry) Len() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.proxies)
+}
+
+func (r *Registry) List() []ConnInfo {
+	r.mu.RLock()
+	conns := make([]ConnInfo, 0, len(r.proxies))
+	for _, p := range r.proxies {
+		conns = append(conns, p.Info())
+	}
+	r.mu.RUnlock()
+
+	sort.Slice(conns, func(i, j int) bool {
+		return conns[i].Id < conns[j].Id
+	})
+	return conns
+}
@@ -0,0 +1,64 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+)
+
+var (
+	errHandshakeNotRecorded = errors.New("handshake exceeds the replay limit, cannot replay")
+	errHandshakeReplayOff   = errors.New("handshake replay disabled, set a replay limit")
+)
+
+// SetHandshakeReplayLimit records up to limit handshake bytes for ReplayHandshake, a larger handshake is dropped and
+// cannot be replayed. Nothing is recorded by default or with 0
+func (p *Proxy) SetHandshakeReplayLimit(limit int) {
+	if p.startedWarn("SetHandshakeReplayLimit") {
+		return
+	}
+	p.replayLimit = limit
+}
+
+// HandshakeBytes returns the handshake written to the remote: the payload sequence, the trojan request and the
+// rewritten CONNECT request (lPayload) in the order sent. Transport handshakes (TLS, websocket, h2) are not part of it,
+// they are redone by dialing. It returns nil when the handshake exceeds the replay limit or none is set.
+func (p *Proxy) HandshakeBytes() []byte {
+	p.replayMu.Lock()
+	defer p.replayMu.Unlock()
+	if p.replayTruncated {
+		return nil
+	}
+	return append([]byte(nil), p.replayBuff...)
+}
+
+// ReplayHandshake writes the recorded handshake to conn, a freshly dialed remote replacing the broken one
+func (p *Proxy) ReplayHandshake(conn net.Conn) error {
+	p.replayMu.Lock()
+	defer p.replayMu.Unlock()
+	if p.replayLimit <= 0 {
+		return errHandshakeReplayOff
+	}
+	if p.replayTruncated {
+		return errHandshakeNotRecorded
+	}
+	if len(p.replayBuff) == 0 {
+		return nil
+	}
+	_, err := conn.Write(p.replayBuff)
+	return err
+}
+
+// recordHandshake keeps b for ReplayHandshake until the replay limit is exceeded
+func (p *Proxy) recordHandshake(b []byte) {
+	p.replayMu.Lock()
+	defer p.replayMu.Unlock()
+	if p.replayLimit <= 0 || p.replayTruncated || len(b) == 0 {
+		return
+	}
+	if len(p.replayBuff)+len(b) > p.replayLimit {
+		p.replayTruncated = true
+		p.replayBuff = nil
+		return
+	}
+	p.replayBuff = append(p.replayBuff, b...)
+}
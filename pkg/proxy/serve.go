@@ -0,0 +1,203 @@
+package proxy
+
+import (
+	"context"
+	"github.com/lutfailham96/go-tcp-proxy-tunnel/internal/tcp"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// IPLimiter caps the concurrent connections of each client ip
+type IPLimiter = tcp.IPLimiter
+
+// NewIPLimiter allows maxPerIP concurrent connections for each client ip
+func NewIPLimiter(maxPerIP int) *IPLimiter {
+	return tcp.NewIPLimiter(0, maxPerIP)
+}
+
+// Config configures the proxies Serve runs for accepted connections
+type Config struct {
+	// Remote is dialed for every connection, Prepare may pick another one with SetRemoteAddr
+	Remote *net.TCPAddr
+	// Options are applied to every proxy as with New, WithConnId is set by Serve
+	Options []Option
+	// Prepare is called with every proxy and its accepted connection before it starts, for settings without an
+	// Option or picked per connection. The connection is closed instead when it returns an error
+	Prepare func(p *Proxy, conn net.Conn) error
+	// Registry tracks the running proxies when set
+	Registry *Registry
+	// NextConnId returns the id of every connection, share one counter between Serve calls so ids stay unique.
+	// Serve numbers its connections from 1 when nil
+	NextConnId func() uint64
+	// MaxPerIP caps the concurrent connections of each client ip, unlimited if 0
+	MaxPerIP int
+	// Limiter replaces MaxPerIP when set, share one between Serve calls to cap connections across listeners
+	Limiter *IPLimiter
+	// Start runs every proxy instead of go p.Start(), on a worker queue for instance. When it returns false the
+	// proxy is not run, its connection is closed and Done is closed
+	Start func(p *Proxy) bool
+	// ShutdownTimeout is how long active connections may finish once Serve stops accepting before they are
+	// closed, they are closed at once if 0
+	ShutdownTimeout time.Duration
+	// Drained is called when the shutdown finished with the number of connections that finished on their own
+	// and the number closed after ShutdownTimeout
+	Drained func(drained, closed int)
+}
+
+// Serve runs the accept loop of ln and forwards every connection with a Proxy built from cfg, it replaces the
+// accept loop of the cmd for library users. Temporary accept errors are retried. Cancelling ctx or closing ln starts
+// a graceful shutdown, Serve then returns nil once the active connections finished or were closed after
+// cfg.ShutdownTimeout.
+func Serve(ctx context.Context, ln net.Listener, cfg Config) error {
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			ln.Close()
+		case <-stop:
+		}
+	}()
+
+	limiter := cfg.Limiter
+	if limiter == nil && cfg.MaxPerIP > 0 {
+		limiter = NewIPLimiter(cfg.MaxPerIP)
+	}
+	nextConnId := cfg.NextConnId
+	if nextConnId == nil {
+		var connId uint64
+		nextConnId = func() uint64 {
+			return atomic.AddUint64(&connId, 1)
+		}
+	}
+	active := &activeProxies{proxies: make(map[*Proxy]struct{})}
+	var lAddr *net.TCPAddr
+	switch addr := ln.Addr().(type) {
+	case *net.TCPAddr:
+		lAddr = addr
+	case *net.UDPAddr:
+		// datagram listeners of the udp-over-tcp kind
+		lAddr = &net.TCPAddr{IP: addr.IP, Port: addr.Port, Zone: addr.Zone}
+	}
+
+	var acceptDelay time.Duration
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if tcp.IsTemporary(err) {
+				acceptDelay = tcp.NextAcceptDelay(acceptDelay)
+				time.Sleep(acceptDelay)
+				continue
+			}
+			drained, closed := active.drain(cfg.ShutdownTimeout)
+			if cfg.Drained != nil {
+				cfg.Drained(drained, closed)
+			}
+			if ctx.Err() != nil || isClosedErr(err) {
+				return nil
+			}
+			return err
+		}
+		acceptDelay = 0
+
+		opts := append([]Option{WithConnId(nextConnId())}, cfg.Options...)
+		p := New(conn, lAddr, cfg.Remote, opts...)
+		if cfg.Registry != nil {
+			p.SetRegistry(cfg.Registry)
+		}
+		// over limit connections are closed before Prepare picks a backend for them
+		if limiter != nil && !limiter.Acquire(conn.RemoteAddr()) {
+			p.event("limit", nil, "too many connections from %s, closing", conn.RemoteAddr())
+			p.discard()
+			continue
+		}
+		if cfg.Prepare != nil {
+			err = cfg.Prepare(p, conn)
+			if err != nil {
+				p.event("prepare_error", err, "cannot prepare proxy '%s'", err)
+				if limiter != nil {
+					limiter.Release(conn.RemoteAddr())
+				}
+				p.discard()
+				continue
+			}
+		}
+		active.add(p)
+		go func(addr net.Addr) {
+			<-p.Done()
+			if limiter != nil {
+				limiter.Release(addr)
+			}
+			active.remove(p)
+		}(conn.RemoteAddr())
+		if cfg.Start == nil {
+			go p.Start()
+		} else if !cfg.Start(p) {
+			p.discard()
+		}
+	}
+}
+
+// discard closes the connection of a proxy that is never started, Done is closed as if it ran
+func (p *Proxy) discard() {
+	tcp.CloseConnection(p.lConn)
+	close(p.done)
+}
+
+// activeProxies tracks the proxies started by Serve until they are done
+type activeProxies struct {
+	wg      sync.WaitGroup
+	mu      sync.Mutex
+	proxies map[*Proxy]struct{}
+}
+
+func (a *activeProxies) add(p *Proxy) {
+	a.wg.Add(1)
+	a.mu.Lock()
+	a.proxies[p] = struct{}{}
+	a.mu.Unlock()
+}
+
+func (a *activeProxies) remove(p *Proxy) {
+	a.mu.Lock()
+	delete(a.proxies, p)
+	a.mu.Unlock()
+	a.wg.Done()
+}
+
+// drain waits up to timeout for the active proxies and closes the ones left, it returns how many finished and
+// how many were closed
+func (a *activeProxies) drain(timeout time.Duration) (int, int) {
+	a.mu.Lock()
+	total := len(a.proxies)
+	a.mu.Unlock()
+	done := make(chan struct{})
+	go func() {
+		a.wg.Wait()
+		close(done)
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+		return total, 0
+	case <-timer.C:
+	}
+	a.mu.Lock()
+	closed := len(a.proxies)
+	for p := range a.proxies {
+		p.event("shutdown", nil, "still open after %s of shutdown, closing", timeout)
+		p.Close()
+	}
+	a.mu.Unlock()
+	<-done
+	return total - closed, closed
+}
+
+// net.ErrClosed needs go 1.16
+func isClosedErr(err error) bool {
+	return strings.Contains(err.Error(), "use of closed network connection")
+}
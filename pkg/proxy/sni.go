@@ -0,0 +1,162 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+)
+
+// largest TLS record, 2^14 bytes of plaintext plus the allowed expansion
+const maxTLSRecordSize = 16384 + 2048
+
+var (
+	errNotTLS         = errors.New("not a TLS handshake")
+	errBadClientHello = errors.New("malformed TLS ClientHello")
+	errNoSNIRoute     = errors.New("no route for SNI")
+)
+
+// SetSNIRoutes routes TLS connections by the SNI of their ClientHello without decrypting them, routes map a server
+// name to the remote address. A name may be a *.example.com wildcard, * matches any other name and ClientHellos
+// without SNI. The ClientHello is forwarded untouched and no payload is rewritten.
+func (p *Proxy) SetSNIRoutes(routes map[string]string) {
+	if p.startedWarn("SetSNIRoutes") {
+		return
+	}
+	p.sniRoutes = routes
+}
+
+// routeSNI peeks the ClientHello of the local side and points the remote at the route of its SNI
+func (p *Proxy) routeSNI() error {
+	lConn := NewPeekConn(p.lConn, nil)
+	p.lConn = lConn
+	sni, err := readClientHello(lConn)
+	if err != nil {
+		return err
+	}
+	route := matchSNIRoute(p.sniRoutes, sni)
+	if route == "" {
+		return errNoSNIRoute
+	}
+	rAddr, err := net.ResolveTCPAddr(p.dialNetwork, route)
+	if err != nil {
+		return err
+	}
+	p.event("sni_route", nil, "routing SNI '%s' to %s", sni, route)
+	p.rAddr = rAddr
+	p.rHost = route
+	p.sniRouted = true
+	p.passthrough = true
+	return nil
+}
+
+func matchSNIRoute(routes map[string]string, sni string) string {
+	sni = strings.ToLower(strings.TrimSuffix(sni, "."))
+	if sni != "" {
+		if route, ok := routes[sni]; ok {
+			return route
+		}
+		// the longest wildcard wins
+		for i := strings.IndexByte(sni, '.'); i >= 0; i = strings.IndexByte(sni, '.') {
+			sni = sni[i+1:]
+			if route, ok := routes["*."+sni]; ok {
+				return route
+			}
+		}
+	}
+	return routes["*"]
+}
+
+// readClientHello peeks the first TLS record of conn, which must hold a ClientHello, and returns its SNI
+func readClientHello(conn *PeekConn) (string, error) {
+	header, err := conn.Peek(5)
+	if err != nil {
+		return "", err
+	}
+	if header[0] != 0x16 {
+		return "", errNotTLS
+	}
+	length := int(binary.BigEndian.Uint16(header[3:5]))
+	if length > maxTLSRecordSize {
+		return "", errBadClientHello
+	}
+	record, err := conn.Peek(5 + length)
+	if err != nil {
+		return "", err
+	}
+	return clientHelloSNI(record[5:])
+}
+
+// clientHelloSNI returns the host_name of the server_name extension, empty when the ClientHello has none
+func clientHelloSNI(b []byte) (string, error) {
+	// handshake type and length, client version, random
+	if len(b) < 38 || b[0] != 0x01 {
+		return "", errBadClientHello
+	}
+	b = b[38:]
+	// session id, cipher suites, compression methods
+	for _, lengthSize := range []int{1, 2, 1} {
+		var ok bool
+		b, ok = skipVector(b, lengthSize)
+		if !ok {
+			return "", errBadClientHello
+		}
+	}
+	if len(b) < 2 {
+		return "", nil
+	}
+	extensions, ok := vector(b, 2)
+	if !ok {
+		return "", errBadClientHello
+	}
+
+	for len(extensions) >= 4 {
+		extType := binary.BigEndian.Uint16(extensions[:2])
+		data, ok := vector(extensions[2:], 2)
+		if !ok {
+			return "", errBadClientHello
+		}
+		extensions = extensions[4+len(data):]
+		if extType != 0 {
+			continue
+		}
+		names, ok := vector(data, 2)
+		if !ok {
+			return "", errBadClientHello
+		}
+		for len(names) >= 3 {
+			name, ok := vector(names[1:], 2)
+			if !ok {
+				return "", errBadClientHello
+			}
+			if names[0] == 0 {
+				return string(name), nil
+			}
+			names = names[3+len(name):]
+		}
+	}
+	return "", nil
+}
+
+// vector returns the contents of a TLS vector with a big endian length prefix of lengthSize bytes
+func vector(b []byte, lengthSize int) ([]byte, bool) {
+	if len(b) < lengthSize {
+		return nil, false
+	}
+	length := 0
+	for _, c := range b[:lengthSize] {
+		length = length<<8 | int(c)
+	}
+	if len(b) < lengthSize+length {
+		return nil, false
+	}
+	return b[lengthSize : lengthSize+length], true
+}
+
+func skipVector(b []byte, lengthSize int) ([]byte, bool) {
+	v, ok := vector(b, lengthSize)
+	if !ok {
+		return nil, false
+	}
+	return b[lengthSize+len(v):], true
+}
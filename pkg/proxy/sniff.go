@@ -0,0 +1,67 @@
+package proxy
+
+import (
+	"bytes"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// ProtocolSniffer shares one port between the tunnel and plain TCP, connections starting with Magic are handled
+// as a tunnel and the others are forwarded untouched to Raw. Connections sending nothing within Timeout are raw too,
+// their clients wait for the server to speak first.
+type ProtocolSniffer struct {
+	Magic   []byte
+	Raw     string
+	Timeout time.Duration
+}
+
+// SetProtocolSniffer peeks the first bytes of every connection before dialing to pick the tunnel or raw forwarding,
+// the peeked bytes are forwarded as if they were never read
+func (p *Proxy) SetProtocolSniffer(sniffer ProtocolSniffer) {
+	if p.startedWarn("SetProtocolSniffer") {
+		return
+	}
+	p.sniffer = &sniffer
+}
+
+// sniffProtocol reads until the peeked bytes match or differ from the magic and points raw connections at Raw
+func (p *Proxy) sniffProtocol() error {
+	magic := p.sniffer.Magic
+	if p.sniffer.Timeout > 0 {
+		p.lConn.SetReadDeadline(time.Now().Add(p.sniffer.Timeout))
+	}
+	// read whatever is available, the tunnel handshake is parsed from the first read of the replayed bytes
+	var peeked []byte
+	buffer := make([]byte, atomic.LoadUint64(&p.buffSize))
+	var err error
+	for len(peeked) < len(magic) && bytes.HasPrefix(magic, peeked) {
+		var n int
+		n, err = p.lConn.Read(buffer)
+		peeked = append(peeked, buffer[:n]...)
+		if err != nil {
+			break
+		}
+	}
+	p.lConn.SetReadDeadline(time.Time{})
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() && len(peeked) == 0 {
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+	p.lConn = NewPeekConn(p.lConn, peeked)
+
+	if len(magic) > 0 && bytes.HasPrefix(peeked, magic) {
+		return nil
+	}
+	rAddr, err := net.ResolveTCPAddr(p.dialNetwork, p.sniffer.Raw)
+	if err != nil {
+		return err
+	}
+	p.event("sniff", nil, "not a tunnel connection, forwarding raw to %s", p.sniffer.Raw)
+	p.rAddr = rAddr
+	p.rHost = p.sniffer.Raw
+	p.passthrough = true
+	return nil
+}
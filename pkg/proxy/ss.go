@@ -0,0 +1,159 @@
+package proxy
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/lutfailham96/go-tcp-proxy-tunnel/internal/tcp"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+const (
+	// ssKeySize is the key size of chacha20-ietf-poly1305, the only supported cipher
+	ssKeySize = 32
+	// ssSaltCacheSize is how many recent salts the server side refuses to see again
+	ssSaltCacheSize = 1 << 15
+)
+
+// the salts of every server side connection share one cache, replays arrive on new connections
+var ssSalts = tcp.NewSSSaltCache(ssSaltCacheSize)
+
+var (
+	errNoSSKey    = errors.New("shadowsocks key not set")
+	errNoSSTarget = errors.New("shadowsocks target not set, use the server host")
+)
+
+// SetSSCipher selects the Shadowsocks AEAD cipher of the ss proxy kind, only chacha20-ietf-poly1305 is supported
+func (p *Proxy) SetSSCipher(cipher string) error {
+	if p.startedWarn("SetSSCipher") {
+		return errProxyStarted
+	}
+	if cipher != tcp.SSCipherChacha20 {
+		return fmt.Errorf("unsupported shadowsocks cipher '%s'", cipher)
+	}
+	return nil
+}
+
+// SetSSKey sets the 32 byte key of the ss proxy kind, SSPasswordKey derives it from a password. The client side
+// encrypts the stream to the remote and sends the server host as target, the server side decrypts the local stream
+// and forwards it to the remote
+func (p *Proxy) SetSSKey(key []byte) error {
+	if p.startedWarn("SetSSKey") {
+		return errProxyStarted
+	}
+	if len(key) != ssKeySize {
+		return fmt.Errorf("shadowsocks key must be %d bytes", ssKeySize)
+	}
+	p.ssKey = key
+	return nil
+}
+
+// SSPasswordKey derives a key from password the way Shadowsocks clients do (EVP_BytesToKey with MD5)
+func SSPasswordKey(password string) []byte {
+	var key, prev []byte
+	h := md5.New()
+	for len(key) < ssKeySize {
+		h.Reset()
+		h.Write(prev)
+		h.Write([]byte(password))
+		prev = h.Sum(nil)
+		key = append(key, prev...)
+	}
+	return key[:ssKeySize]
+}
+
+// ssClientHandshake encrypts the remote side and sends the target address as the first bytes of the stream
+func (p *Proxy) ssClientHandshake() error {
+	if p.ssKey == nil {
+		return errNoSSKey
+	}
+	if p.sHost.HostName == "" {
+		return errNoSSTarget
+	}
+	address, err := socksAddress(net.JoinHostPort(p.sHost.HostName, strconv.FormatUint(p.sHost.Port, 10)))
+	if err != nil {
+		return err
+	}
+	ssConn, err := tcp.NewSSConn(p.rConn, p.ssKey)
+	if err != nil {
+		return err
+	}
+	_, err = ssConn.Write(address)
+	if err != nil {
+		return err
+	}
+	p.rConn = ssConn
+	p.lInitialized = true
+	p.rInitialized = true
+	return nil
+}
+
+// ssServerHandshake decrypts the local side and reads the target address, the stream goes to the configured remote.
+// Streams that replay a recent salt are refused.
+func (p *Proxy) ssServerHandshake() error {
+	if p.ssKey == nil {
+		return errNoSSKey
+	}
+	if p.handshakeTimeout <= 0 {
+		// Start already set the handshake timeout deadline otherwise
+		p.lConn.SetReadDeadline(time.Now().Add(headTimeout))
+		defer p.lConn.SetReadDeadline(time.Time{})
+	}
+	ssConn, err := tcp.NewSSConn(p.lConn, p.ssKey)
+	if err != nil {
+		return err
+	}
+	ssConn.SetSaltCache(ssSalts)
+	target, err := readSocksAddress(ssConn)
+	if err != nil {
+		return err
+	}
+	p.logAt(LevelDebug, "ss_target", nil, "shadowsocks target %s", target)
+	p.lConn = ssConn
+	p.lInitialized = true
+	p.rInitialized = true
+	return nil
+}
+
+// readSocksAddress reads ATYP DST.ADDR DST.PORT from r
+func readSocksAddress(r io.Reader) (string, error) {
+	atyp := make([]byte, 1)
+	_, err := io.ReadFull(r, atyp)
+	if err != nil {
+		return "", err
+	}
+	var host string
+	switch atyp[0] {
+	case atypIPv4, atypIPv6:
+		ip := make([]byte, net.IPv4len)
+		if atyp[0] == atypIPv6 {
+			ip = make([]byte, net.IPv6len)
+		}
+		_, err = io.ReadFull(r, ip)
+		host = net.IP(ip).String()
+	case atypDomain:
+		size := make([]byte, 1)
+		_, err = io.ReadFull(r, size)
+		if err != nil {
+			return "", err
+		}
+		domain := make([]byte, size[0])
+		_, err = io.ReadFull(r, domain)
+		host = string(domain)
+	default:
+		return "", fmt.Errorf("unknown address type %d", atyp[0])
+	}
+	if err != nil {
+		return "", err
+	}
+	port := make([]byte, 2)
+	_, err = io.ReadFull(r, port)
+	if err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
@@ -0,0 +1,72 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	utls "github.com/refraction-networking/utls"
+	"io"
+	"net"
+	"strings"
+)
+
+// tlsHandshakeError is a failed remote TLS handshake, reason tells what to check
+type tlsHandshakeError struct {
+	reason string
+	err    error
+}
+
+func (e *tlsHandshakeError) Error() string {
+	return fmt.Sprintf("tls handshake failed, %s: %s", e.reason, e.err)
+}
+
+func (e *tlsHandshakeError) Unwrap() error {
+	return e.err
+}
+
+// classifyTLSError wraps err from a remote TLS handshake sent with serverName as SNI
+func classifyTLSError(err error, serverName string) error {
+	return &tlsHandshakeError{reason: tlsErrorReason(err, serverName), err: err}
+}
+
+func tlsErrorReason(err error, serverName string) string {
+	var unknownAuthority x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidCert x509.CertificateInvalidError
+	var recordHeader tls.RecordHeaderError
+	var uRecordHeader utls.RecordHeaderError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &unknownAuthority):
+		return "remote certificate is signed by an unknown authority"
+	case errors.As(err, &hostnameErr):
+		return fmt.Sprintf("remote certificate is not valid for SNI '%s'", serverName)
+	case errors.As(err, &invalidCert):
+		return "remote certificate is expired or not valid"
+	case errors.As(err, &recordHeader) || errors.As(err, &uRecordHeader):
+		return "remote did not answer with TLS, check the remote port or disable TLS"
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "remote did not complete the handshake in time"
+	case errors.Is(err, io.EOF) || strings.Contains(err.Error(), "connection reset"):
+		return fmt.Sprintf("remote closed the connection, SNI '%s' may be rejected or blocked", serverName)
+	}
+
+	// alerts sent by the remote are only exposed as text
+	msg := err.Error()
+	switch {
+	case strings.Contains(msg, "protocol version not supported"):
+		return "remote does not support the offered TLS versions"
+	case strings.Contains(msg, "unrecognized name"):
+		return fmt.Sprintf("remote does not serve SNI '%s'", serverName)
+	case strings.Contains(msg, "no application protocol"):
+		return "remote does not support ALPN h2"
+	case strings.Contains(msg, "handshake failure"):
+		return "remote rejected the handshake, no common cipher suite or SNI not served"
+	case strings.Contains(msg, "unexpected handshake message"):
+		return "remote sent an unexpected handshake message, it may not be a TLS server"
+	case strings.Contains(msg, "no renegotiation"):
+		return "remote refused renegotiation"
+	}
+	return "unknown cause"
+}
@@ -0,0 +1,116 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+)
+
+// Trojan request written to the remote before any client data once a password is set:
+//
+//	hex(SHA224(password)) CRLF CMD ATYP DST.ADDR DST.PORT CRLF
+//
+// CMD is 0x01 (connect), ATYP, DST.ADDR and DST.PORT use SOCKS5 addressing. The server answers with the
+// target stream directly, there is no response header.
+const (
+	trojanCmdConnect = 0x01
+	atypIPv4         = 0x01
+	atypDomain       = 0x03
+	atypIPv6         = 0x04
+)
+
+var errNoTrojanTarget = errors.New("trojan target not set")
+
+// SetTrojanPassword frames the connection as a Trojan request on the trojan proxy kind instead of rewriting the
+// request path, the target is set with SetTrojanTarget or falls back to the server host
+func (p *Proxy) SetTrojanPassword(password string) {
+	if p.startedWarn("SetTrojanPassword") {
+		return
+	}
+	p.trojanPassword = password
+}
+
+// SetTrojanTarget sets the host:port the Trojan server connects to
+func (p *Proxy) SetTrojanTarget(target string) error {
+	if p.startedWarn("SetTrojanTarget") {
+		return errProxyStarted
+	}
+	_, err := socksAddress(target)
+	if err != nil {
+		return err
+	}
+	p.trojanTarget = target
+	return nil
+}
+
+// CheckTrojanTarget returns the error SetTrojanTarget would return for target
+func CheckTrojanTarget(target string) error {
+	_, err := socksAddress(target)
+	return err
+}
+
+func (p *Proxy) writeTrojanRequest() error {
+	target := p.trojanTarget
+	if target == "" && p.sHost.HostName != "" {
+		target = net.JoinHostPort(p.sHost.HostName, strconv.FormatUint(p.sHost.Port, 10))
+	}
+	if target == "" {
+		return errNoTrojanTarget
+	}
+	request, err := trojanRequest(p.trojanPassword, target)
+	if err != nil {
+		return err
+	}
+	_, err = p.rConn.Write(request)
+	if err != nil {
+		return err
+	}
+	p.recordHandshake(request)
+	return nil
+}
+
+func trojanRequest(password, target string) ([]byte, error) {
+	address, err := socksAddress(target)
+	if err != nil {
+		return nil, err
+	}
+	hash := sha256.Sum224([]byte(password))
+	request := make([]byte, 0, hex.EncodedLen(len(hash))+2+1+len(address)+2)
+	request = append(request, hex.EncodeToString(hash[:])...)
+	request = append(request, "\r\n"...)
+	request = append(request, trojanCmdConnect)
+	request = append(request, address...)
+	return append(request, "\r\n"...), nil
+}
+
+// socksAddress encodes host:port as ATYP DST.ADDR DST.PORT
+func socksAddress(target string) ([]byte, error) {
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return nil, err
+	}
+	portNum, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid target port '%s'", port)
+	}
+
+	var address []byte
+	ip := net.ParseIP(host)
+	switch {
+	case ip.To4() != nil:
+		address = append([]byte{atypIPv4}, ip.To4()...)
+	case ip != nil:
+		address = append([]byte{atypIPv6}, ip.To16()...)
+	case host == "" || len(host) > 255:
+		return nil, fmt.Errorf("invalid target host '%s'", host)
+	default:
+		address = append([]byte{atypDomain, byte(len(host))}, host...)
+	}
+	portBytes := make([]byte, 2)
+	binary.BigEndian.PutUint16(portBytes, uint16(portNum))
+	return append(address, portBytes...), nil
+}
@@ -0,0 +1,34 @@
+package proxy
+
+import (
+	"github.com/lutfailham96/go-tcp-proxy-tunnel/internal/tcp"
+	"net"
+	"strings"
+)
+
+// frameDatagrams wraps the stream side of the udp-over-tcp proxy kind. The client side reads datagrams from a
+// tcp.UDPListener session and sends them over the remote stream each prefixed by its 2 byte length, the server side
+// decapsulates them and sends them as UDP to the remote, replies travel back the same way. There is no handshake.
+func (p *Proxy) frameDatagrams() {
+	if p.serverProxyMode {
+		p.lConn = tcp.NewUDPFrameConn(p.lConn)
+	} else {
+		p.rConn = tcp.NewUDPFrameConn(p.rConn)
+	}
+	p.lInitialized = true
+	p.rInitialized = true
+	p.lWritten = true
+}
+
+// dialsUDP reports whether the remote is dialed over UDP, the server side of udp-over-tcp
+func (p *Proxy) dialsUDP() bool {
+	return p.proxyKind == "udp-over-tcp" && p.serverProxyMode && !p.passthrough
+}
+
+// udpDialArgs turns the tcp dial network and source address into their udp counterparts
+func udpDialArgs(network string, localAddr net.Addr) (string, net.Addr) {
+	if tcpAddr, ok := localAddr.(*net.TCPAddr); ok {
+		localAddr = &net.UDPAddr{IP: tcpAddr.IP, Zone: tcpAddr.Zone}
+	}
+	return strings.Replace(network, "tcp", "udp", 1), localAddr
+}